@@ -0,0 +1,134 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// Agent implementation for local development, reads lines from in and prints replies to out
+// single chat, stops at the end of input
+
+const prompt = "> "
+
+type Agent struct {
+	in     io.Reader
+	out    io.Writer
+	sender conversation.User
+
+	mu sync.Mutex
+}
+
+func NewBot(in io.Reader, out io.Writer, sender conversation.User) (conversation.Agent, error) {
+	if in == nil || out == nil {
+		return nil, fmt.Errorf("console input and output are required")
+	}
+	return &Agent{
+		in:     in,
+		out:    out,
+		sender: sender,
+	}, nil
+}
+
+func (a *Agent) print(s string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	io.WriteString(a.out, s)
+}
+
+func (a *Agent) Run(ctx context.Context) (chan conversation.Update, error) {
+	updates := make(chan conversation.Update)
+	lines := make(chan string)
+
+	// reading cant be interrupted, so it is done apart and left blocked on stop
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(a.in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	go func() {
+		defer close(updates)
+		a.print(prompt)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				updates <- newUpdate(a, line)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+type Update struct {
+	agent *Agent
+	text  string
+}
+
+func newUpdate(agent *Agent, text string) *Update {
+	return &Update{agent: agent, text: text}
+}
+
+func (upd *Update) Provider() string { return "console" }
+
+func (upd *Update) ChatID() string { return "console" }
+
+func (upd *Update) GetSender() conversation.User {
+	return upd.agent.sender
+}
+
+func (upd *Update) GetMessage() string {
+	return upd.text
+}
+
+// only text is supported
+func (upd *Update) GetAttachments() []conversation.Attachment {
+	return nil
+}
+
+// there is no phone number to share, see conversation.ContactSharing
+func (upd *Update) CanShareContact() bool {
+	return false
+}
+
+func (upd *Update) Reply(text string) error {
+	return upd.ReplyWithKeyboard(text, conversation.Keyboard{})
+}
+
+func (upd *Update) ReplyWithKeyboard(text string, kb conversation.Keyboard) error {
+	var b strings.Builder
+	fmt.Fprintln(&b, conversation.ParseMarkup(text).Plain())
+	for _, row := range kb.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		b.WriteString("   ")
+		for _, button := range row {
+			fmt.Fprintf(&b, " [%s]", button.Text)
+		}
+		b.WriteString("\n")
+	}
+	upd.agent.print(b.String())
+	return nil
+}
+
+// there is no keyboard to remove
+func (upd *Update) ReplyRemovingKeyboard(text string) error {
+	return upd.Reply(text)
+}
+
+// prompt for the next line once all replies are printed
+func (upd *Update) Complete() {
+	upd.agent.print(prompt)
+}
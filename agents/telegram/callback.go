@@ -0,0 +1,91 @@
+package tg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// inline keyboards, pressed button comes back as a callback query
+
+const (
+	// callback data is limited to 64 bytes, longer options are referred to by index
+	maxCallbackData = 64
+	textPrefix      = "t:"
+	indexPrefix     = "i:"
+	selectedMark    = "✓ "
+)
+
+func newInlineKeyboard(kb conversation.Keyboard) tgbotapi.InlineKeyboardMarkup {
+	buttons := make([][]tgbotapi.InlineKeyboardButton, 0, len(kb.Rows))
+	index := 0
+	for _, row := range kb.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		buttonsRow := make([]tgbotapi.InlineKeyboardButton, len(row))
+		for i, b := range row {
+			data := textPrefix + b.Text
+			if len(data) > maxCallbackData {
+				data = indexPrefix + strconv.Itoa(index)
+			}
+			buttonsRow[i] = tgbotapi.NewInlineKeyboardButtonData(b.Text, data)
+			index++
+		}
+		buttons = append(buttons, buttonsRow)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(buttons...)
+}
+
+// text of the pressed button
+func callbackOption(cb *tgbotapi.CallbackQuery) string {
+	if text, found := strings.CutPrefix(cb.Data, textPrefix); found {
+		return text
+	}
+	if i, found := strings.CutPrefix(cb.Data, indexPrefix); found && cb.Message != nil && cb.Message.ReplyMarkup != nil {
+		index, err := strconv.Atoi(i)
+		if err != nil {
+			return ""
+		}
+		for _, row := range cb.Message.ReplyMarkup.InlineKeyboard {
+			if index < len(row) {
+				return row[index].Text
+			}
+			index -= len(row)
+		}
+	}
+	return ""
+}
+
+// answers callback query so the client stops showing progress
+// and replaces the keyboard of the message with the selected option
+func (upd *Update) acknowledge() {
+	cb := upd.update.CallbackQuery
+	if cb == nil {
+		return
+	}
+	if _, err := upd.api.Request(tgbotapi.NewCallback(cb.ID, "")); err != nil {
+		logger.Println("cant answer callback query: ", err.Error())
+	}
+	option := callbackOption(cb)
+	if cb.Message == nil || option == "" {
+		return
+	}
+	// the edit removes the buttons
+	upd.inline.forget(upd.ChatID(), cb.Message.MessageID)
+	if _, err := upd.send(selectedEdit(cb.Message, option)); err != nil {
+		logger.Println("cant mark selected option: ", err.Error())
+	}
+}
+
+// message with the option appended, formatting of the message is kept by its entities
+// as the text before them doesnt change
+func selectedEdit(msg *tgbotapi.Message, option string) tgbotapi.EditMessageTextConfig {
+	text := fmt.Sprint(msg.Text, "\n\n", selectedMark, option)
+	edit := tgbotapi.NewEditMessageText(msg.Chat.ID, msg.MessageID, text)
+	edit.Entities = msg.Entities
+	return edit
+}
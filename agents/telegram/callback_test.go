@@ -0,0 +1,19 @@
+package tg
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestSelectedEditKeepsFormatting(t *testing.T) {
+	bold := tgbotapi.MessageEntity{Type: "bold", Offset: 0, Length: 5}
+	msg := &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 2}, Text: "Name?", Entities: []tgbotapi.MessageEntity{bold}}
+	edit := selectedEdit(msg, "Ann")
+	if edit.Text != "Name?\n\n"+selectedMark+"Ann" {
+		t.Errorf("got text %q", edit.Text)
+	}
+	if len(edit.Entities) != 1 || edit.Entities[0] != bold {
+		t.Errorf("got entities %v, want the ones of the message", edit.Entities)
+	}
+}
@@ -0,0 +1,44 @@
+package tg
+
+import "strings"
+
+// group chats, see conversation.GroupUpdate
+// with privacy mode on tg delivers only commands, mentions, replies to the bot and its inline buttons
+
+func (upd *Update) InGroup() bool {
+	ch := upd.update.FromChat()
+	return ch != nil && !ch.IsPrivate()
+}
+
+// contact buttons are reply keyboard buttons, in groups only inline ones reach the bot,
+// see conversation.ContactSharing
+func (upd *Update) CanShareContact() bool {
+	return !upd.InGroup()
+}
+
+func (upd *Update) Addressed() bool {
+	if upd.update.CallbackQuery != nil {
+		return true
+	}
+	msg := upd.update.Message
+	if msg == nil {
+		return false
+	}
+	if reply := msg.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == upd.api.Self.ID {
+		return true
+	}
+	if msg.IsCommand() {
+		// commands of other bots look like /start@otherbot
+		_, bot, found := strings.Cut(msg.CommandWithAt(), "@")
+		return !found || strings.EqualFold(bot, upd.api.Self.UserName)
+	}
+	return upd.api.Self.UserName != "" && strings.Contains(strings.ToLower(msg.Text+msg.Caption), "@"+strings.ToLower(upd.api.Self.UserName))
+}
+
+// text without the mention of the bot, /start@bot becomes /start
+func (upd *Update) stripMention(text string) string {
+	if upd.api.Self.UserName == "" {
+		return text
+	}
+	return strings.TrimSpace(strings.ReplaceAll(text, "@"+upd.api.Self.UserName, ""))
+}
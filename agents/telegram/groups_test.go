@@ -0,0 +1,30 @@
+package tg
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+func TestContactSharingInGroups(t *testing.T) {
+	tests := []struct {
+		chatType string
+		want     bool
+	}{
+		{"private", true},
+		{"group", false},
+		{"supergroup", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chatType, func(t *testing.T) {
+			upd := &Update{update: tgbotapi.Update{Message: &tgbotapi.Message{
+				Chat: &tgbotapi.Chat{ID: 1, Type: tt.chatType},
+				Text: "hi",
+			}}}
+			if got := conversation.CanShareContact(upd); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tg
+
+import (
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// old inline buttons stay under their messages and can still be pressed,
+// so they are removed once the conversation shows another keyboard
+
+// more conversations are not tracked, their buttons are forgotten
+const maxInlineMessages = 10000
+
+type inlineMessage struct {
+	chatID    int64
+	messageID int
+}
+
+// last message with inline buttons of every conversation
+type inlineMessages struct {
+	mu       sync.Mutex
+	messages map[string]inlineMessage
+}
+
+func newInlineMessages() *inlineMessages {
+	return &inlineMessages{messages: make(map[string]inlineMessage)}
+}
+
+// remembers the message of the conversation if it has buttons, returns the previous one
+func (m *inlineMessages) swap(key string, sent tgbotapi.Message, inline bool) (inlineMessage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, found := m.messages[key]
+	delete(m.messages, key)
+	if inline && sent.Chat != nil {
+		if len(m.messages) >= maxInlineMessages {
+			clear(m.messages)
+		}
+		m.messages[key] = inlineMessage{chatID: sent.Chat.ID, messageID: sent.MessageID}
+	}
+	return prev, found
+}
+
+// buttons of the message are already gone
+func (m *inlineMessages) forget(key string, messageID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.messages[key].messageID == messageID {
+		delete(m.messages, key)
+	}
+}
+
+// removes the buttons of the previous inline message of the conversation
+func (upd *Update) replaceInline(sent tgbotapi.Message, inline bool) {
+	prev, found := upd.inline.swap(upd.ChatID(), sent, inline)
+	if !found {
+		return
+	}
+	edit := tgbotapi.NewEditMessageReplyMarkup(prev.chatID, prev.messageID, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}})
+	if _, err := upd.send(edit); err != nil {
+		logger.Println("cant remove old inline buttons: ", err.Error())
+	}
+}
+
+func (upd *Update) ReplyRemovingKeyboard(text string) error {
+	reply_to := upd.update.FromChat()
+	if reply_to == nil {
+		return upd.Reply(text)
+	}
+	text, err := upd.sendLeading(reply_to.ID, text)
+	if err != nil {
+		logger.Println(err.Error())
+		return err
+	}
+	msg := upd.newMessage(reply_to.ID, text)
+	// selective in groups, only the member the message replies to loses the keyboard
+	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	sent, err := upd.send(msg)
+	if err != nil {
+		logger.Println(err.Error())
+		return err
+	}
+	upd.replaceInline(sent, false)
+	return nil
+}
@@ -1,8 +1,13 @@
 package tg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/spanditime/go-survey-bot/conversation"
@@ -11,7 +16,12 @@ import (
 // Agent implementation tg
 
 type Agent struct {
-	api *tgbotapi.BotAPI
+	api    *tgbotapi.BotAPI
+	out    *conversation.Outbox
+	inline *inlineMessages
+	// webhook mode if set, long polling otherwise
+	webhook        *WebhookConfig
+	webhookUpdates chan tgbotapi.Update
 }
 
 func NewBot(token string, logger tgbotapi.BotLogger) (conversation.Agent, error) {
@@ -27,10 +37,27 @@ func NewBot(token string, logger tgbotapi.BotLogger) (conversation.Agent, error)
 	}
 
 	return &Agent{
-		api: botapi,
+		api:    botapi,
+		out:    conversation.NewOutbox(conversation.OutboxConfig{RateLimit: RateLimit, Retry: retryAfter}),
+		inline: newInlineMessages(),
 	}, err
 }
 
+// tg allows about 30 messages per second overall and 1 per second in a chat, short bursts are fine
+var RateLimit = conversation.RateLimit{Global: 30, GlobalBurst: 30, Chat: 1, ChatBurst: 3}
+
+// flood errors come with retry_after, server errors are retried with backoff
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second, true
+	}
+	return 0, apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
+
 var logger tgbotapi.BotLogger = log.Default()
 
 func setLogger(l tgbotapi.BotLogger) error{
@@ -42,36 +69,82 @@ func setLogger(l tgbotapi.BotLogger) error{
 	return err
 }
 
-func (tg *Agent) Run() (chan conversation.Update, error) {
+func (tg *Agent) Run(ctx context.Context) (chan conversation.Update, error) {
+	if tg.webhook != nil {
+		return tg.runWebhook(ctx)
+	}
+	// updates cant be polled while webhook is set
+	if _, err := tg.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("cant delete webhook: %w", err)
+	}
 	u := tgbotapi.NewUpdate(0)
 	tg_updates := tg.api.GetUpdatesChan(u)
 	updates := make(chan conversation.Update)
 	go func() {
+		<-ctx.Done()
+		logger.Println("stopping receiving updates")
+		tg.api.StopReceivingUpdates()
+	}()
+	go func() {
+		// forwards already received updates until tgbotapi closes the channel
 		for tg_update := range tg_updates {
-			update := newUpdate(tg.api, tg_update)
+			if !supported(tg_update) {
+				continue
+			}
+			update := newUpdate(tg.api, tg.out, tg.inline, tg_update)
+			go update.acknowledge()
 			updates <- update
 		}
+		close(updates)
 	}()
 	return updates, nil
 }
 
+// only messages and button presses are answers, edits and others would come as empty messages
+func supported(tg_update tgbotapi.Update) bool {
+	return tg_update.Message != nil || tg_update.CallbackQuery != nil
+}
+
 type Update struct {
 	api    *tgbotapi.BotAPI
+	out    *conversation.Outbox
+	inline *inlineMessages
 	update tgbotapi.Update
 }
 
-func newUpdate(api *tgbotapi.BotAPI, tg_update tgbotapi.Update) *Update {
+func newUpdate(api *tgbotapi.BotAPI, out *conversation.Outbox, inline *inlineMessages, tg_update tgbotapi.Update) *Update {
 	return &Update{
 		api:    api,
+		out:    out,
+		inline: inline,
 		update: tg_update,
 	}
 }
 
+// sends through the outbox of the agent, waits for the turn of the chat
+func (upd *Update) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	chat := "tg"
+	if ch := upd.update.FromChat(); ch != nil {
+		chat = fmt.Sprint("tg", ch.ID)
+	}
+	var sent tgbotapi.Message
+	err := upd.out.Send(chat, func() error {
+		var err error
+		sent, err = upd.api.Send(c)
+		return err
+	})
+	return sent, err
+}
+
 func (upd *Update) Provider() string {
 	return "tg"
 }
+// members of a group have their own sessions, see conversation.GroupUpdate
 func (upd *Update) ChatID() string {
 	ch := upd.update.FromChat()
+	if from := upd.update.SentFrom(); ch != nil && !ch.IsPrivate() && from != nil {
+		return fmt.Sprint("tg", ch.ID, ":", from.ID)
+	}
 	if ch != nil {
 		return fmt.Sprint("tg", ch.ID)
 	}
@@ -99,42 +172,168 @@ func (upd *Update) GetSender() conversation.User {
 func (upd *Update) GetMessage() string {
 	msg := upd.update.Message
 	if msg != nil {
-		return msg.Text
+		text := msg.Text
+		if text == "" {
+			text = msg.Caption
+		}
+		if upd.InGroup() {
+			return upd.stripMention(text)
+		}
+		return text
+	}
+	if cb := upd.update.CallbackQuery; cb != nil {
+		return callbackOption(cb)
 	}
 	return ""
 }
+func (upd *Update) GetAttachments() []conversation.Attachment {
+	msg := upd.update.Message
+	if msg == nil {
+		return nil
+	}
+	attachments := []conversation.Attachment{}
+	// sizes of the same photo, the largest is the last one
+	if len(msg.Photo) > 0 {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.PhotoAttachment, ID: msg.Photo[len(msg.Photo)-1].FileID})
+	}
+	if msg.Document != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.DocumentAttachment, ID: msg.Document.FileID, Name: msg.Document.FileName})
+	}
+	if msg.Voice != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.VoiceAttachment, ID: msg.Voice.FileID})
+	}
+	if msg.Audio != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.AudioAttachment, ID: msg.Audio.FileID, Name: msg.Audio.FileName})
+	}
+	if msg.Video != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.VideoAttachment, ID: msg.Video.FileID, Name: msg.Video.FileName})
+	}
+	if msg.VideoNote != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.VideoAttachment, ID: msg.VideoNote.FileID})
+	}
+	if msg.Sticker != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.StickerAttachment, ID: msg.Sticker.FileID})
+	}
+	if msg.Contact != nil {
+		attachments = append(attachments, conversation.Attachment{
+			Type:  conversation.ContactAttachment,
+			ID:    fmt.Sprint(msg.Contact.UserID),
+			Name:  strings.TrimSpace(msg.Contact.FirstName + " " + msg.Contact.LastName),
+			Phone: msg.Contact.PhoneNumber,
+			// contact button shares the account of the sender, any other contact can be attached too
+			Verified: msg.From != nil && msg.Contact.UserID == msg.From.ID,
+		})
+	}
+	if msg.Animation != nil && msg.Document == nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.VideoAttachment, ID: msg.Animation.FileID, Name: msg.Animation.FileName})
+	}
+	if msg.Location != nil || msg.Venue != nil || msg.Poll != nil || msg.Dice != nil {
+		attachments = append(attachments, conversation.Attachment{Type: conversation.OtherAttachment})
+	}
+	return attachments
+}
+// markup text to the chat of the update, in groups it replies to the message of the member
+func (upd *Update) newMessage(chatID int64, text string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, conversation.ParseMarkup(text).HTML())
+	msg.ParseMode = tgbotapi.ModeHTML
+	if upd.InGroup() && upd.update.Message != nil {
+		msg.ReplyToMessageID = upd.update.Message.MessageID
+	}
+	return msg
+}
+
+// sends long text in parts but the last one, it is returned to go with the keyboard
+func (upd *Update) sendLeading(chatID int64, text string) (string, error) {
+	parts := conversation.SplitText(text, conversation.MaxMessageLength)
+	for _, part := range parts[:len(parts)-1] {
+		if _, err := upd.send(upd.newMessage(chatID, part)); err != nil {
+			return "", err
+		}
+	}
+	return parts[len(parts)-1], nil
+}
+
 func (upd *Update) Reply(text string) error {
-	reply_to := upd.update.Message
+	reply_to := upd.update.FromChat()
 	if reply_to != nil {
-		msg := tgbotapi.NewMessage(reply_to.Chat.ID, text)
-		_, err := upd.api.Send(msg)
+		text, err := upd.sendLeading(reply_to.ID, text)
 		if err != nil {
 			logger.Printf(err.Error())
 			return err
 		}
+		msg := upd.newMessage(reply_to.ID, text)
+		_, err = upd.send(msg)
+		if err != nil {
+			logger.Printf(err.Error())
+			return err
+		}
+		return nil
+	}
+	err := fmt.Errorf("nobody to reply to on update: %v", upd.update)
+	logger.Println(err.Error())
+	return err
+}
+// tgbotapi doesnt know about is_persistent yet
+type replyKeyboard struct {
+	tgbotapi.ReplyKeyboardMarkup
+	IsPersistent bool `json:"is_persistent,omitempty"`
+}
+
+func newReplyKeyboard(kb conversation.Keyboard) replyKeyboard {
+	buttons := make([][]tgbotapi.KeyboardButton, 0, len(kb.Rows))
+	for _, row := range kb.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		buttonsRow := make([]tgbotapi.KeyboardButton, len(row))
+		for i, b := range row {
+			if b.RequestContact {
+				buttonsRow[i] = tgbotapi.NewKeyboardButtonContact(b.Text)
+			} else {
+				buttonsRow[i] = tgbotapi.NewKeyboardButton(b.Text)
+			}
+		}
+		buttons = append(buttons, buttonsRow)
+	}
+	markup := tgbotapi.NewReplyKeyboard(buttons...)
+	markup.OneTimeKeyboard = kb.OneTime
+	return replyKeyboard{
+		ReplyKeyboardMarkup: markup,
+		IsPersistent:        kb.Persistent,
 	}
-	//todo log an error here)
-	return nil
 }
-func (upd *Update) ReplyWithKeyboard(text string, kb []string) error {
-	reply_to := upd.update.Message
+
+func (upd *Update) ReplyWithKeyboard(text string, kb conversation.Keyboard) error {
+	reply_to := upd.update.FromChat()
 	if reply_to != nil {
-		var buttons [][]tgbotapi.KeyboardButton = make([][]tgbotapi.KeyboardButton, len(kb))
-		for i, b := range kb {
-			buttons[i] = []tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButton(b)}
+		text, err := upd.sendLeading(reply_to.ID, text)
+		if err != nil {
+			logger.Printf(err.Error())
+			return err
 		}
-		keyb := tgbotapi.NewReplyKeyboard(buttons...)
-		msg := tgbotapi.NewMessage(reply_to.Chat.ID, text)
-		msg.ReplyMarkup = keyb
-		_, err := upd.api.Send(msg)
+		msg := upd.newMessage(reply_to.ID, text)
+		inline := false
+		switch {
+		case kb.Empty():
+		// inline buttons cant request the contact,
+		// presses of reply keyboards in groups dont reach the bot with privacy mode on
+		case kb.Inline && !kb.RequestsContact() || upd.InGroup():
+			msg.ReplyMarkup = newInlineKeyboard(kb)
+			inline = true
+		default:
+			msg.ReplyMarkup = newReplyKeyboard(kb)
+		}
+		sent, err := upd.send(msg)
 		if err != nil {
 			logger.Printf(err.Error())
 			return err
 		}
+		if !kb.Empty() {
+			upd.replaceInline(sent, inline)
+		}
 		return nil
 	}
-	//todo log an error here)
-	err := fmt.Errorf("nobody to reply to on update: ", upd.update)
+	err := fmt.Errorf("nobody to reply to on update: %v", upd.update)
 	logger.Println(err.Error())
-	return nil
+	return err
 }
@@ -0,0 +1,132 @@
+package tg
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// Agent implementation tg via webhook
+
+type WebhookConfig struct {
+	// public url telegram sends updates to, e.g. https://bot.example.org/tg
+	URL string
+	// address of the http server, e.g. :8443
+	Listen string
+	// telegram sends it in X-Telegram-Bot-Api-Secret-Token header, updates without it are rejected
+	// required, otherwise anyone could post updates of any chat
+	SecretToken string
+	// serve https with these files, plain http if empty (when tls is terminated by a reverse proxy)
+	CertFile string
+	KeyFile  string
+}
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+func NewWebhookBot(token string, config WebhookConfig, logger tgbotapi.BotLogger) (conversation.Agent, error) {
+	if config.URL == "" || config.Listen == "" {
+		return nil, fmt.Errorf("webhook url and listen address are required")
+	}
+	if config.SecretToken == "" {
+		return nil, fmt.Errorf("webhook secret token is required")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("bad webhook url: %w", err)
+	}
+	agent, err := NewBot(token, logger)
+	if err != nil {
+		return nil, err
+	}
+	tg := agent.(*Agent)
+	tg.webhook = &config
+	tg.webhookUpdates = make(chan tgbotapi.Update)
+	return tg, nil
+}
+
+// http handler of webhook requests, recorded updates can be posted to it to test the bot locally
+func (tg *Agent) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tg.webhook == nil {
+			http.Error(w, "webhook mode is off", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		secret := r.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(tg.webhook.SecretToken)) != 1 {
+			logger.Println("webhook request with wrong secret token from ", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var update tgbotapi.Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "bad update", http.StatusBadRequest)
+			return
+		}
+		select {
+		case tg.webhookUpdates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+			// an error makes telegram send it again
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func (tg *Agent) setWebhook() error {
+	params := tgbotapi.Params{"url": tg.webhook.URL}
+	params.AddNonEmpty("secret_token", tg.webhook.SecretToken)
+	_, err := tg.api.MakeRequest("setWebhook", params)
+	return err
+}
+
+func (tg *Agent) runWebhook(ctx context.Context) (chan conversation.Update, error) {
+	hookURL, _ := url.Parse(tg.webhook.URL)
+	path := hookURL.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, tg.WebhookHandler())
+	// telegram gets the webhook only once the server listens
+	ctx, stop := context.WithCancel(ctx)
+	stopped, err := conversation.Serve(ctx, "tg webhook", tg.webhook.Listen, tg.webhook.CertFile, tg.webhook.KeyFile, mux)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if err := tg.setWebhook(); err != nil {
+		stop()
+		<-stopped
+		return nil, fmt.Errorf("cant set webhook: %w", err)
+	}
+
+	updates := make(chan conversation.Update)
+	go func() {
+		defer close(updates)
+		defer stop()
+		for {
+			select {
+			case tg_update := <-tg.webhookUpdates:
+				if !supported(tg_update) {
+					continue
+				}
+				update := newUpdate(tg.api, tg.out, tg.inline, tg_update)
+				go update.acknowledge()
+				updates <- update
+			// updates of requests in flight are forwarded by then
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
@@ -0,0 +1,90 @@
+package tg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	tg := &Agent{
+		webhook:        &WebhookConfig{SecretToken: "secret"},
+		webhookUpdates: make(chan tgbotapi.Update, 1),
+	}
+	update := `{"update_id":1,"message":{"message_id":2,"from":{"id":3},"chat":{"id":3,"type":"private"},"text":"/start"}}`
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   int
+	}{
+		{"wrong secret", "guess", update, http.StatusForbidden},
+		{"no secret", "", update, http.StatusForbidden},
+		{"bad json", "secret", "{", http.StatusBadRequest},
+		{"update", "secret", update, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/tg", strings.NewReader(tt.body))
+			if tt.secret != "" {
+				r.Header.Set(secretTokenHeader, tt.secret)
+			}
+			w := httptest.NewRecorder()
+			tg.WebhookHandler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	select {
+	case got := <-tg.webhookUpdates:
+		if got.Message == nil || got.Message.Text != "/start" || got.Message.Chat.ID != 3 {
+			t.Errorf("got %+v, want the posted update", got)
+		}
+	default:
+		t.Error("update was not forwarded")
+	}
+	if len(tg.webhookUpdates) != 0 {
+		t.Error("rejected update was forwarded")
+	}
+}
+
+func TestBusyWebhookAsksForRetry(t *testing.T) {
+	tg := &Agent{
+		webhook:        &WebhookConfig{SecretToken: "secret"},
+		webhookUpdates: make(chan tgbotapi.Update),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	update := `{"update_id":1,"message":{"message_id":2,"from":{"id":3},"chat":{"id":3,"type":"private"},"text":"/start"}}`
+	r := httptest.NewRequest(http.MethodPost, "/tg", strings.NewReader(update)).WithContext(ctx)
+	r.Header.Set(secretTokenHeader, "secret")
+	w := httptest.NewRecorder()
+	tg.WebhookHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d so telegram retries the update", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSupportedUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		update tgbotapi.Update
+		want   bool
+	}{
+		{"message", tgbotapi.Update{Message: &tgbotapi.Message{}}, true},
+		{"button press", tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{}}, true},
+		{"edited message", tgbotapi.Update{EditedMessage: &tgbotapi.Message{}}, false},
+		{"member update", tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{}}, false},
+	}
+	for _, tt := range tests {
+		if got := supported(tt.update); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SevereCloud/vksdk/v3/api"
+	"github.com/SevereCloud/vksdk/v3/callback"
+	"github.com/SevereCloud/vksdk/v3/events"
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// Agent implementation vk via Callback API
+
+type CallbackConfig struct {
+	// address of the http server, e.g. :8081
+	Listen string
+	// path vk posts events to, "/" if empty
+	Path string
+	// string vk expects in response to the confirmation event
+	Confirmation string
+	// secret key from the community settings, events without it are rejected
+	// required, otherwise anyone could post events of any chat
+	SecretKey string
+	// serve https with these files, plain http if empty (when tls is terminated by a reverse proxy)
+	CertFile string
+	KeyFile  string
+}
+
+const (
+	// events are acknowledged right away and wait here to be handled
+	callbackQueueSize = 256
+	// vk retries the event after this delay when queue is full
+	callbackRetryAfter = 5 * time.Second
+)
+
+type CallbackAgent struct {
+	*client
+	cb     *callback.Callback
+	config CallbackConfig
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan events.MessageNewObject
+}
+
+func NewCallbackBot(token string, config CallbackConfig, l *log.Logger) (conversation.Agent, error) {
+	setLogger(l)
+	if token == "" {
+		return nil, fmt.Errorf("vk token is empty")
+	}
+	if config.Listen == "" || config.Confirmation == "" {
+		return nil, fmt.Errorf("vk callback listen address and confirmation string are required")
+	}
+	if config.SecretKey == "" {
+		return nil, fmt.Errorf("vk callback secret key is required")
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	vk := api.NewVK(token)
+	if vk == nil {
+		return nil, fmt.Errorf("vk api initialization failed")
+	}
+	groups, err := vk.GroupsGetByID(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cant get vk community: %w", err)
+	}
+	if len(groups.Groups) == 0 {
+		return nil, fmt.Errorf("vk token is not a community token")
+	}
+	cb := callback.NewCallback()
+	cb.ConfirmationKey = config.Confirmation
+	cb.SecretKey = config.SecretKey
+	cb.ErrorLog = l
+	a := &CallbackAgent{
+		client: newClient(vk, groups.Groups[0].ID),
+		cb:     cb,
+		config: config,
+		queue:  make(chan events.MessageNewObject, callbackQueueSize),
+	}
+	cb.MessageNew(a.enqueue)
+	return a, nil
+}
+
+// never blocks so vk gets its "ok" quickly
+func (a *CallbackAgent) enqueue(ctx context.Context, obj events.MessageNewObject) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		callback.RetryAfter(ctx, http.StatusServiceUnavailable, time.Now().Add(callbackRetryAfter))
+		return
+	}
+	select {
+	case a.queue <- obj:
+	default:
+		logger.Println("callback queue is full, asking vk to retry")
+		callback.RetryAfter(ctx, http.StatusServiceUnavailable, time.Now().Add(callbackRetryAfter))
+	}
+}
+
+// http handler of callback api requests, recorded events can be posted to it to test the bot locally
+func (a *CallbackAgent) Handler() http.Handler {
+	return http.HandlerFunc(a.cb.HandleFunc)
+}
+
+func (a *CallbackAgent) Run(ctx context.Context) (chan conversation.Update, error) {
+	mux := http.NewServeMux()
+	mux.Handle(a.config.Path, a.Handler())
+	stopped, err := conversation.Serve(ctx, "vk callback", a.config.Listen, a.config.CertFile, a.config.KeyFile, mux)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(chan conversation.Update)
+
+	go func() {
+		<-stopped
+		// queued events are still forwarded
+		a.mu.Lock()
+		a.closed = true
+		close(a.queue)
+		a.mu.Unlock()
+	}()
+	go func() {
+		for obj := range a.queue {
+			updates <- newUpdate(a.client, obj)
+		}
+		close(updates)
+	}()
+	return updates, nil
+}
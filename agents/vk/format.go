@@ -0,0 +1,53 @@
+package vk
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// markup of the replies is sent as plain text with format_data ranges over it, see conversation.ParseMarkup
+
+type formatItem struct {
+	Type string `json:"type"`
+	// in utf-16 code units
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+}
+
+type formatData struct {
+	Version string       `json:"version"`
+	Items   []formatItem `json:"items"`
+}
+
+// plain text and its format_data, empty if there is no formatting
+func formatMarkup(text string) (string, string) {
+	var b strings.Builder
+	data := formatData{Version: "1"}
+	offset := 0
+	for _, span := range conversation.ParseMarkup(text) {
+		length := len(utf16.Encode([]rune(span.Text)))
+		if span.Bold {
+			data.Items = append(data.Items, formatItem{Type: "bold", Offset: offset, Length: length})
+		}
+		if span.Italic {
+			data.Items = append(data.Items, formatItem{Type: "italic", Offset: offset, Length: length})
+		}
+		if span.URL != "" {
+			data.Items = append(data.Items, formatItem{Type: "url", Offset: offset, Length: length, URL: span.URL})
+		}
+		b.WriteString(span.Text)
+		offset += length
+	}
+	if len(data.Items) == 0 {
+		return b.String(), ""
+	}
+	format, err := json.Marshal(data)
+	if err != nil {
+		return conversation.ParseMarkup(text).Plain(), ""
+	}
+	return b.String(), string(format)
+}
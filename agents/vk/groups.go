@@ -0,0 +1,32 @@
+package vk
+
+import "strings"
+
+// group chats, see conversation.GroupUpdate
+// community sees all messages of a chat only if it has access to them, mentions and replies always
+
+// peer ids of group chats start from this one
+const chatPeerOffset = 2000000000
+
+func (upd *Update) InGroup() bool {
+	return upd.obj.Message.PeerID > chatPeerOffset
+}
+
+func (upd *Update) Addressed() bool {
+	msg := upd.obj.Message
+	switch {
+	// keyboard buttons come with a payload
+	case msg.Payload != "":
+		return true
+	case msg.ReplyMessage != nil && msg.ReplyMessage.FromID == -upd.groupID:
+		return true
+	case strings.HasPrefix(msg.Text, "/"):
+		return true
+	}
+	return upd.mention.MatchString(msg.Text)
+}
+
+// text without the mention of the community
+func (upd *Update) stripMention(text string) string {
+	return strings.TrimSpace(upd.mention.ReplaceAllString(text, ""))
+}
@@ -0,0 +1,183 @@
+package vk
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/SevereCloud/vksdk/v3/api"
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// old inline buttons stay under their messages and can still be pressed,
+// so they are removed once the conversation shows another keyboard
+
+const (
+	// more conversations are not tracked, their buttons are forgotten
+	maxInlineMessages = 10000
+	// vk rejects bigger keyboards
+	maxInlineRows    = 6
+	maxInlineButtons = 10
+	maxRows          = 10
+	maxButtons       = 40
+	maxRowButtons    = 5
+)
+
+// keyboard rearranged to fit the limits of vk,
+// inline keyboard with too many buttons becomes the usual one, except in group chats
+// where it has to stay with its message, there the buttons that dont fit are left out
+// and their options can still be typed
+func fitKeyboard(kb conversation.Keyboard, group bool) conversation.Keyboard {
+	var rows [][]conversation.Button
+	buttons := 0
+	for _, row := range kb.Rows {
+		if len(row) > 0 {
+			rows = append(rows, row)
+			buttons += len(row)
+		}
+	}
+	if kb.Inline && !group && buttons > maxInlineButtons {
+		kb.Inline = false
+	}
+	rowLimit, buttonLimit := maxRows, maxButtons
+	if kb.Inline {
+		rowLimit, buttonLimit = maxInlineRows, maxInlineButtons
+	}
+	rows = trimButtons(rows, buttonLimit)
+
+	kb.Rows = nil
+	for _, row := range rows {
+		for len(row) > maxRowButtons {
+			kb.Rows = append(kb.Rows, row[:maxRowButtons])
+			row = row[maxRowButtons:]
+		}
+		kb.Rows = append(kb.Rows, row)
+	}
+	if len(kb.Rows) <= rowLimit {
+		return kb
+	}
+	var all []conversation.Button
+	for _, row := range kb.Rows {
+		all = append(all, row...)
+	}
+	// not more than maxRowButtons, the button limits are at most that many times the row limits
+	perRow := (len(all) + rowLimit - 1) / rowLimit
+	kb.Rows = nil
+	for len(all) > 0 {
+		n := min(perRow, len(all))
+		kb.Rows = append(kb.Rows, all[:n])
+		all = all[n:]
+	}
+	return kb
+}
+
+// first buttons up to the limit, the last row is kept since navigation like cancel is usually there
+func trimButtons(rows [][]conversation.Button, limit int) [][]conversation.Button {
+	buttons := 0
+	for _, row := range rows {
+		buttons += len(row)
+	}
+	if buttons <= limit {
+		return rows
+	}
+	last := rows[len(rows)-1]
+	if len(last) >= limit {
+		return [][]conversation.Button{last[:limit]}
+	}
+	left := limit - len(last)
+	var trimmed [][]conversation.Button
+	for _, row := range rows[:len(rows)-1] {
+		if left == 0 {
+			break
+		}
+		row = row[:min(len(row), left)]
+		trimmed = append(trimmed, row)
+		left -= len(row)
+	}
+	return append(trimmed, last)
+}
+
+// messages.edit needs the text again
+type inlineMessage struct {
+	peerID    int
+	messageID int
+	params    api.Params
+}
+
+// last message with inline buttons of every conversation
+type inlineMessages struct {
+	mu       sync.Mutex
+	messages map[string]inlineMessage
+}
+
+func newInlineMessages() *inlineMessages {
+	return &inlineMessages{messages: make(map[string]inlineMessage)}
+}
+
+// remembers the message of the conversation if it has buttons, returns the previous one
+func (m *inlineMessages) swap(key string, sent inlineMessage, inline bool) (inlineMessage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, found := m.messages[key]
+	delete(m.messages, key)
+	// vk doesnt return ids of messages sent to group chats
+	if inline && sent.messageID > 0 {
+		if len(m.messages) >= maxInlineMessages {
+			clear(m.messages)
+		}
+		m.messages[key] = sent
+	}
+	return prev, found
+}
+
+// removes the buttons of the previous inline message of the conversation
+func (upd *Update) replaceInline(sent inlineMessage, inline bool) {
+	prev, found := upd.inline.swap(upd.ChatID(), sent, inline)
+	if !found {
+		return
+	}
+	keyboard, _ := json.Marshal(newKeyboard(conversation.Keyboard{Inline: true}))
+	params := api.Params{
+		"peer_id":               prev.peerID,
+		"message_id":            prev.messageID,
+		"message":               prev.params["message"],
+		"keyboard":              string(keyboard),
+		"keep_forward_messages": true,
+	}
+	if format, found := prev.params["format_data"]; found {
+		params["format_data"] = format
+	}
+	err := upd.out.Send(fmt.Sprint("vk", prev.peerID), func() error {
+		_, err := upd.vk.MessagesEdit(params)
+		return err
+	})
+	if err != nil {
+		logger.Println("cant remove old inline buttons: ", err.Error())
+	}
+}
+
+// empty keyboard hides the keyboard of the chat
+func (upd *Update) ReplyRemovingKeyboard(text string) error {
+	if upd == nil || upd.client == nil {
+		return fmt.Errorf("vk update/api is nil")
+	}
+	if upd.obj.Message.PeerID == 0 {
+		return fmt.Errorf("vk peer_id is 0")
+	}
+	keyboard, err := json.Marshal(newKeyboard(conversation.Keyboard{}))
+	if err != nil {
+		return fmt.Errorf("json marshal failed: %v", err)
+	}
+	text, err = upd.sendLeading(text)
+	if err != nil {
+		return err
+	}
+	params := upd.messageParams(text)
+	params["keyboard"] = string(keyboard)
+	id, err := upd.send(params)
+	if err != nil {
+		return err
+	}
+	upd.replaceInline(inlineMessage{peerID: upd.obj.Message.PeerID, messageID: id, params: params}, false)
+	return nil
+}
@@ -0,0 +1,67 @@
+package vk
+
+import (
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// one button per row as the survey places them
+func column(n int) conversation.Keyboard {
+	kb := conversation.Keyboard{Inline: true}
+	for range n {
+		kb.Rows = append(kb.Rows, []conversation.Button{{Text: "option"}})
+	}
+	return kb
+}
+
+func TestFitKeyboard(t *testing.T) {
+	wide := conversation.Keyboard{Rows: [][]conversation.Button{make([]conversation.Button, 7)}}
+	tests := []struct {
+		name    string
+		kb      conversation.Keyboard
+		group   bool
+		inline  bool
+		rows    int
+		buttons int
+	}{
+		{"fits", column(4), false, true, 4, 4},
+		{"review screen", column(9), false, true, 5, 9},
+		{"too many buttons", column(12), false, false, 6, 12},
+		{"usual keyboard", conversation.Keyboard{Rows: column(11).Rows}, false, false, 6, 11},
+		{"wide row", wide, false, false, 2, 7},
+		{"wide inline row", conversation.Keyboard{Inline: true, Rows: wide.Rows}, false, true, 2, 7},
+		{"group keyboard with too many buttons", column(12), true, true, 5, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kb := fitKeyboard(tt.kb, tt.group)
+			if kb.Inline != tt.inline || len(kb.Rows) != tt.rows {
+				t.Errorf("got inline %v with %d rows, want %v with %d", kb.Inline, len(kb.Rows), tt.inline, tt.rows)
+			}
+			buttons := 0
+			for _, row := range kb.Rows {
+				buttons += len(row)
+				if len(row) > maxRowButtons {
+					t.Errorf("got a row of %d buttons", len(row))
+				}
+			}
+			if buttons != tt.buttons {
+				t.Errorf("got %d buttons, want %d", buttons, tt.buttons)
+			}
+			if kb.Inline && (len(kb.Rows) > maxInlineRows || buttons > maxInlineButtons) || len(kb.Rows) > maxRows {
+				t.Errorf("keyboard is over the limits")
+			}
+		})
+	}
+}
+
+func TestTrimmedKeyboardKeepsLastRow(t *testing.T) {
+	kb := column(12)
+	kb.Rows[11] = []conversation.Button{{Text: "Cancel"}}
+	kb = fitKeyboard(kb, true)
+	last := kb.Rows[len(kb.Rows)-1]
+	if last[len(last)-1].Text != "Cancel" {
+		t.Errorf("got %v, want cancel to stay", kb.Rows)
+	}
+}
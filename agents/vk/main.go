@@ -3,9 +3,12 @@ package vk
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SevereCloud/vksdk/v3/api"
@@ -17,10 +20,33 @@ import (
 // Agent implementation vk via Long Poll
 
 type Agent struct {
-	vk *api.VK
+	*client
 	lp *longpoll.LongPoll
 }
 
+// api of the community shared by the agent and its updates
+type client struct {
+	vk       *api.VK
+	out      *conversation.Outbox
+	profiles *profileCache
+	inline   *inlineMessages
+	// messages of the community come from -groupID
+	groupID int
+	// mention of the community in a group chat, e.g. [club1|@survey]
+	mention *regexp.Regexp
+}
+
+func newClient(vk *api.VK, groupID int) *client {
+	return &client{
+		vk:       vk,
+		out:      conversation.NewOutbox(conversation.OutboxConfig{RateLimit: RateLimit, Retry: retryable}),
+		profiles: newProfileCache(vk),
+		inline:   newInlineMessages(),
+		groupID:  groupID,
+		mention:  regexp.MustCompile(fmt.Sprintf(`\[club%d\|[^\]]*\][,\s]*`, groupID)),
+	}
+}
+
 func NewBot(token string, l *log.Logger) (conversation.Agent, error) {
 	setLogger(l)
 	if token == "" {
@@ -38,11 +64,20 @@ func NewBot(token string, l *log.Logger) (conversation.Agent, error) {
 		return nil, fmt.Errorf("vk longpoll initialization failed")
 	}
 	return &Agent{
-		vk: vk,
-		lp: lp,
+		client: newClient(vk, lp.GroupID),
+		lp:     lp,
 	}, nil
 }
 
+// vk allows 20 requests per second for a community token, api.VK keeps to it on its own
+// chat limit is not documented, keep it close to the tg one
+var RateLimit = conversation.RateLimit{Global: 20, GlobalBurst: 20, Chat: 1, ChatBurst: 3}
+
+// vk doesnt say how long to wait, too many requests, flood control and server errors are retried with backoff
+func retryable(err error) (time.Duration, bool) {
+	return 0, errors.Is(err, api.ErrTooMany) || errors.Is(err, api.ErrFlood) || errors.Is(err, api.ErrServer)
+}
+
 type Logger interface{
 	Println(v... interface{})
 }
@@ -57,29 +92,38 @@ func setLogger(l Logger) error{
 	return nil
 }
 
-func (a *Agent) Run() (chan conversation.Update, error) {
-	if a == nil || a.vk == nil || a.lp == nil {
+func (a *Agent) Run(ctx context.Context) (chan conversation.Update, error) {
+	if a == nil || a.client == nil || a.lp == nil {
 		return nil, fmt.Errorf("vk agent is not initialized")
 	}
 	updates := make(chan conversation.Update)
 
-	a.lp.MessageNew(func(ctx context.Context, obj events.MessageNewObject) {
-		if updates != nil {
-			updates <- newUpdate(a.vk, obj)
-		}
+	// called from the longpoll loop, so nothing is sent after it returns
+	a.lp.MessageNew(func(_ context.Context, obj events.MessageNewObject) {
+		updates <- newUpdate(a.client, obj)
 	})
 
-	go func() { 
-		for true{
+	go func() {
+		defer close(updates)
+		for {
 			logger.Println("starting longpoll-bot")
-			err := a.lp.Run()
+			err := a.lp.RunWithContext(ctx)
+			if ctx.Err() != nil {
+				logger.Println("longpoll-bot stopped")
+				return
+			}
 			if err != nil {
-				logger.Println("longpoll-bot stopped with error: " , err.Error() )
-			}else{
+				logger.Println("longpoll-bot stopped with error: ", err.Error())
+			} else {
 				logger.Println("longpoll-bot stopped with no error")
 			}
-			logger.Println("restarting longpoll-bot after 5 seconds" )
-			time.Sleep(time.Second * 5)
+			logger.Println("restarting longpoll-bot after 5 seconds")
+			select {
+			case <-ctx.Done():
+				logger.Println("longpoll-bot stopped")
+				return
+			case <-time.After(time.Second * 5):
+			}
 		}
 	}()
 
@@ -87,12 +131,24 @@ func (a *Agent) Run() (chan conversation.Update, error) {
 }
 
 type Update struct {
-	vk  *api.VK
+	*client
 	obj events.MessageNewObject
 }
 
-func newUpdate(vk *api.VK, obj events.MessageNewObject) *Update {
-	return &Update{vk: vk, obj: obj}
+func newUpdate(c *client, obj events.MessageNewObject) *Update {
+	return &Update{client: c, obj: obj}
+}
+
+// sends through the outbox of the agent, waits for the turn of the chat
+// returns id of the sent message
+func (upd *Update) send(params api.Params) (int, error) {
+	var id int
+	err := upd.out.Send(fmt.Sprint("vk", upd.obj.Message.PeerID), func() error {
+		var err error
+		id, err = upd.vk.MessagesSend(params)
+		return err
+	})
+	return id, err
 }
 
 func (upd *Update) Provider() string { return "vk" }
@@ -101,6 +157,10 @@ func (upd *Update) ChatID() string {
 	if upd == nil {
 		return "vk"
 	}
+	// members of a group chat have their own sessions, see conversation.GroupUpdate
+	if upd.InGroup() {
+		return fmt.Sprint("vk", upd.obj.Message.PeerID, ":", upd.obj.Message.FromID)
+	}
 	if upd.obj.Message.PeerID != 0 {
 		return fmt.Sprint("vk", upd.obj.Message.PeerID)
 	}
@@ -113,13 +173,13 @@ func (upd *Update) GetSender() conversation.User {
 	}
 	fromID := upd.obj.Message.FromID
 	user := conversation.User{Id: fmt.Sprint("vk", fromID)}
-	if fromID > 0 && upd.vk != nil {
-		if users, err := upd.vk.UsersGet(api.Params{"user_ids": strconv.Itoa(fromID)}); err == nil && len(users) > 0 {
-			user.Name = users[0].FirstName
-			user.Surname = users[0].LastName
-			username := users[0].Nickname
+	if fromID > 0 && upd.client != nil {
+		if profile, err := upd.profiles.get(fromID, profileTTL); err == nil {
+			user.Name = profile.FirstName
+			user.Surname = profile.LastName
+			username := profile.Nickname
 			if len(username)==0 {
-				username = "https://vk.com/id" + strconv.Itoa(users[0].ID)
+				username = "https://vk.com/id" + strconv.Itoa(profile.ID)
 			}else{
 				username = "@" + username
 			}
@@ -129,62 +189,192 @@ func (upd *Update) GetSender() conversation.User {
 	return user
 }
 
-func (upd *Update) GetMessage() string { return upd.obj.Message.Text }
+func (upd *Update) GetMessage() string {
+	if upd.InGroup() {
+		return upd.stripMention(upd.obj.Message.Text)
+	}
+	return upd.obj.Message.Text
+}
+
+const (
+	// payload of the button sharing the phone number
+	contactPayload = `{"request":"contact"}`
+	// user may have just made the number visible, older profiles are fetched again
+	contactMaxAge = time.Minute
+)
+
+// vk has no contact button, the number is taken from the profile of the sender if it is visible to the group
+func (upd *Update) sharedContact() (conversation.Attachment, bool) {
+	fromID := upd.obj.Message.FromID
+	if upd.obj.Message.Payload != contactPayload || fromID <= 0 || upd.client == nil {
+		return conversation.Attachment{}, false
+	}
+	profile, err := upd.profiles.get(fromID, contactMaxAge)
+	if err != nil {
+		logger.Println("cant get contacts of the user: ", err.Error())
+		return conversation.Attachment{}, false
+	}
+	if profile.MobilePhone == "" {
+		return conversation.Attachment{}, false
+	}
+	return conversation.Attachment{
+		Type:     conversation.ContactAttachment,
+		ID:       strconv.Itoa(fromID),
+		Name:     strings.TrimSpace(profile.FirstName + " " + profile.LastName),
+		Phone:    profile.MobilePhone,
+		Verified: true,
+	}, true
+}
+
+func (upd *Update) GetAttachments() []conversation.Attachment {
+	if upd == nil {
+		return nil
+	}
+	attachments := []conversation.Attachment{}
+	for _, a := range upd.obj.Message.Attachments {
+		switch a.Type {
+		case "photo":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.PhotoAttachment, ID: a.Photo.ToAttachment(), URL: a.Photo.MaxSize().URL})
+		case "doc":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.DocumentAttachment, ID: a.Doc.ToAttachment(), URL: a.Doc.URL, Name: a.Doc.Title})
+		case "audio_message":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.VoiceAttachment, ID: a.AudioMessage.ToAttachment(), URL: a.AudioMessage.LinkMp3})
+		case "audio":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.AudioAttachment, ID: a.Audio.ToAttachment(), URL: a.Audio.URL})
+		case "video":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.VideoAttachment, ID: a.Video.ToAttachment()})
+		case "sticker":
+			attachments = append(attachments, conversation.Attachment{Type: conversation.StickerAttachment, ID: strconv.Itoa(a.Sticker.StickerID)})
+		default:
+			attachments = append(attachments, conversation.Attachment{Type: conversation.OtherAttachment, ID: a.Type})
+		}
+	}
+	if contact, found := upd.sharedContact(); found {
+		attachments = append(attachments, contact)
+	}
+	return attachments
+}
+
+// markup text to the peer of the update, in groups it replies to the message of the member
+func (upd *Update) messageParams(text string) api.Params {
+	message, format := formatMarkup(text)
+	params := api.Params{
+		"peer_id": upd.obj.Message.PeerID,
+		"message": message,
+		// same random_id on retries so vk doesnt deliver the message twice
+		"random_id": int(time.Now().UnixNano() & 0x7fffffff),
+	}
+	if format != "" {
+		params["format_data"] = format
+	}
+	if upd.InGroup() {
+		params["forward"] = fmt.Sprintf(`{"peer_id":%d,"conversation_message_ids":[%d],"is_reply":true}`,
+			upd.obj.Message.PeerID, upd.obj.Message.ConversationMessageID)
+	}
+	return params
+}
+
+// sends long text in parts but the last one, it is returned to go with the keyboard
+func (upd *Update) sendLeading(text string) (string, error) {
+	parts := conversation.SplitText(text, conversation.MaxMessageLength)
+	for _, part := range parts[:len(parts)-1] {
+		if _, err := upd.send(upd.messageParams(part)); err != nil {
+			return "", err
+		}
+	}
+	return parts[len(parts)-1], nil
+}
 
 func (upd *Update) Reply(text string) error {
-	if upd == nil || upd.vk == nil {
+	if upd == nil || upd.client == nil {
 		return fmt.Errorf("vk update/api is nil")
 	}
 	peerID := upd.obj.Message.PeerID
 	if peerID == 0 {
 		return fmt.Errorf("vk peer_id is 0")
 	}
-	_, err := upd.vk.MessagesSend(api.Params{
-		"peer_id":   peerID,
-		"message":   text,
-		"random_id": int(time.Now().UnixNano() & 0x7fffffff),
-	})
+	text, err := upd.sendLeading(text)
+	if err != nil {
+		return err
+	}
+	_, err = upd.send(upd.messageParams(text))
 	return err
 }
 
-func (upd *Update) ReplyWithKeyboard(text string, kb []string) error {
-	if upd == nil || upd.vk == nil {
+func buttonColor(style conversation.ButtonStyle) string {
+	switch style {
+	case conversation.PrimaryButton, conversation.PositiveButton, conversation.NegativeButton:
+		return string(style)
+	}
+	return "secondary"
+}
+
+func newKeyboard(kb conversation.Keyboard) map[string]interface{} {
+	buttons := make([]interface{}, 0, len(kb.Rows))
+	for _, row := range kb.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		buttonsRow := make([]interface{}, len(row))
+		for i, b := range row {
+			payload := "{\"button\": \"1\"}"
+			if b.RequestContact {
+				payload = contactPayload
+			}
+			buttonsRow[i] = map[string]interface{}{
+				"action": map[string]interface{}{
+					"label":   b.Text,
+					"type":    "text",
+					"payload": payload,
+				},
+				"color": buttonColor(b.Style),
+			}
+		}
+		buttons = append(buttons, buttonsRow)
+	}
+	keyboard := map[string]interface{}{
+		"buttons": buttons,
+	}
+	// one_time is not allowed for inline keyboards
+	if kb.Inline {
+		keyboard["inline"] = true
+	} else {
+		keyboard["one_time"] = kb.OneTime
+	}
+	return keyboard
+}
+
+func (upd *Update) ReplyWithKeyboard(text string, kb conversation.Keyboard) error {
+	if upd == nil || upd.client == nil {
 		return fmt.Errorf("vk update/api is nil")
 	}
 	peerID := upd.obj.Message.PeerID
 	if peerID == 0 {
 		return fmt.Errorf("vk peer_id is 0")
 	}
-	if len(kb) == 0 {
+	if kb.Empty() {
 		return upd.Reply(text)
 	}
-	buttons := make([]interface{}, len(kb))
-	for i, label := range kb {
-		buttons[i] = []interface{}{
-			map[string]interface{}{
-				"action": map[string]interface{}{
-					"label":   label,
-					"type":    "text",
-					"payload": "{\"button\": \"1\"}",
-				},
-				"color": "secondary",
-			},
-		}
+	// keyboard stays with the message it was sent to, not with the whole chat
+	if upd.InGroup() {
+		kb.Inline = true
 	}
+	kb = fitKeyboard(kb, upd.InGroup())
 	// convert to json
-	json, err := json.Marshal(map[string]interface{}{
-		"one_time": true,
-		"buttons":  buttons,
-	})
+	json, err := json.Marshal(newKeyboard(kb))
 	if err != nil {
 		return fmt.Errorf("json marshal failed: %v", err)
 	}
-	pars := api.Params{
-		"peer_id":   peerID,
-		"message":   text,
-		"random_id": int(time.Now().UnixNano() & 0x7fffffff),
-		"keyboard":  string(json),
+	text, err = upd.sendLeading(text)
+	if err != nil {
+		return err
 	}
-	_, err = upd.vk.MessagesSend(pars)
-	return err
+	pars := upd.messageParams(text)
+	pars["keyboard"] = string(json)
+	id, err := upd.send(pars)
+	if err != nil {
+		return err
+	}
+	upd.replaceInline(inlineMessage{peerID: peerID, messageID: id, params: pars}, kb.Inline)
+	return nil
 }
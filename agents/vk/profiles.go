@@ -0,0 +1,138 @@
+package vk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SevereCloud/vksdk/v3/api"
+	"github.com/SevereCloud/vksdk/v3/object"
+)
+
+// user profiles are cached, lookups made at about the same time go in one users.get request
+
+const (
+	// profile is fetched again after that
+	profileTTL = 10 * time.Minute
+	// last known profile is used while vk is unavailable, forgotten after that
+	staleProfileTTL = 24 * time.Hour
+	// how long lookups wait for others to join the batch
+	batchDelay = 20 * time.Millisecond
+	// users.get accepts up to 1000 ids, keep the request short
+	maxBatch = 100
+	// contacts for the share phone button, see sharedContact
+	profileFields = "contacts"
+)
+
+type cachedProfile struct {
+	user    object.UsersUser
+	fetched time.Time
+}
+
+type profileBatch struct {
+	ids  []int
+	once sync.Once
+	err  error
+	done chan struct{}
+}
+
+type profileCache struct {
+	// users.get of the api, replaced in tests
+	usersGet func(params api.Params) (api.UsersGetResponse, error)
+
+	mu       sync.Mutex
+	profiles map[int]cachedProfile
+	// batch collecting ids, nil if there is none
+	batch *profileBatch
+	// batches in flight by id
+	pending map[int]*profileBatch
+}
+
+func newProfileCache(vk *api.VK) *profileCache {
+	return &profileCache{
+		usersGet: vk.UsersGet,
+		profiles: make(map[int]cachedProfile),
+		pending:  make(map[int]*profileBatch),
+	}
+}
+
+// profile of the user, not older than maxAge if vk is available
+func (c *profileCache) get(id int, maxAge time.Duration) (object.UsersUser, error) {
+	c.mu.Lock()
+	if p, found := c.profiles[id]; found && time.Since(p.fetched) < maxAge {
+		c.mu.Unlock()
+		return p.user, nil
+	}
+	b, found := c.pending[id]
+	if !found {
+		b = c.join(id)
+	}
+	c.mu.Unlock()
+
+	<-b.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// stale profile is better than none when vk is unavailable
+	if p, found := c.profiles[id]; found {
+		return p.user, nil
+	}
+	if b.err != nil {
+		return object.UsersUser{}, b.err
+	}
+	return object.UsersUser{}, fmt.Errorf("vk user %d not found", id)
+}
+
+// adds id to the collecting batch, called with mu held
+func (c *profileCache) join(id int) *profileBatch {
+	b := c.batch
+	if b == nil {
+		b = &profileBatch{done: make(chan struct{})}
+		c.batch = b
+		time.AfterFunc(batchDelay, func() { c.flush(b) })
+	}
+	b.ids = append(b.ids, id)
+	c.pending[id] = b
+	if len(b.ids) >= maxBatch {
+		c.batch = nil
+		go c.flush(b)
+	}
+	return b
+}
+
+func (c *profileCache) flush(b *profileBatch) {
+	b.once.Do(func() {
+		c.mu.Lock()
+		if c.batch == b {
+			c.batch = nil
+		}
+		c.mu.Unlock()
+
+		ids := make([]string, len(b.ids))
+		for i, id := range b.ids {
+			ids[i] = strconv.Itoa(id)
+		}
+		users, err := c.usersGet(api.Params{"user_ids": strings.Join(ids, ","), "fields": profileFields})
+		if err != nil {
+			logger.Println("cant get vk users: ", err.Error())
+		}
+
+		c.mu.Lock()
+		now := time.Now()
+		for id, p := range c.profiles {
+			if now.Sub(p.fetched) > staleProfileTTL {
+				delete(c.profiles, id)
+			}
+		}
+		for _, user := range users {
+			c.profiles[user.ID] = cachedProfile{user: user, fetched: now}
+		}
+		for _, id := range b.ids {
+			delete(c.pending, id)
+		}
+		b.err = err
+		c.mu.Unlock()
+		close(b.done)
+	})
+}
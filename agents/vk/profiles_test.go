@@ -0,0 +1,100 @@
+package vk
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SevereCloud/vksdk/v3/api"
+	"github.com/SevereCloud/vksdk/v3/object"
+)
+
+// users.get answering with profiles named after the request number
+type fakeUsers struct {
+	mu       sync.Mutex
+	requests [][]string
+	err      error
+}
+
+func (f *fakeUsers) get(params api.Params) (api.UsersGetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := strings.Split(params["user_ids"].(string), ",")
+	f.requests = append(f.requests, ids)
+	if f.err != nil {
+		return nil, f.err
+	}
+	users := api.UsersGetResponse{}
+	for _, id := range ids {
+		n, _ := strconv.Atoi(id)
+		users = append(users, object.UsersUser{ID: n, FirstName: "request " + strconv.Itoa(len(f.requests))})
+	}
+	return users, nil
+}
+
+func (f *fakeUsers) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func newFakeCache() (*profileCache, *fakeUsers) {
+	users := &fakeUsers{}
+	cache := newProfileCache(api.NewVK(""))
+	cache.usersGet = users.get
+	return cache, users
+}
+
+func TestProfilesAreBatched(t *testing.T) {
+	cache, users := newFakeCache()
+	var wg sync.WaitGroup
+	for id := 1; id <= 5; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := cache.get(id, profileTTL)
+			if err != nil || user.ID != id {
+				t.Errorf("got %v, %v, want user %d", user, err, id)
+			}
+		}()
+	}
+	wg.Wait()
+	if users.count() != 1 || len(users.requests[0]) != 5 {
+		t.Errorf("got requests %v, want one with all the ids", users.requests)
+	}
+
+	if _, err := cache.get(3, profileTTL); err != nil || users.count() != 1 {
+		t.Errorf("cached profile is requested again: %v", users.requests)
+	}
+}
+
+func TestProfileIsRefreshedAfterMaxAge(t *testing.T) {
+	cache, users := newFakeCache()
+	if _, err := cache.get(1, profileTTL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	user, err := cache.get(1, time.Millisecond)
+	if err != nil || user.FirstName != "request 2" || users.count() != 2 {
+		t.Errorf("got %q after %d requests, want the refreshed profile", user.FirstName, users.count())
+	}
+}
+
+func TestStaleProfileOnError(t *testing.T) {
+	cache, users := newFakeCache()
+	if _, err := cache.get(1, profileTTL); err != nil {
+		t.Fatal(err)
+	}
+	users.err = errors.New("vk is down")
+	time.Sleep(5 * time.Millisecond)
+	user, err := cache.get(1, time.Millisecond)
+	if err != nil || user.FirstName != "request 1" {
+		t.Errorf("got %q, %v, want the stale profile", user.FirstName, err)
+	}
+	if _, err := cache.get(2, profileTTL); err == nil {
+		t.Error("unknown user without vk has no error")
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/spanditime/go-survey-bot/web
+
+replace github.com/spanditime/go-survey-bot/conversation => ../../conversation
+
+go 1.24.5
+
+require github.com/spanditime/go-survey-bot/conversation v0.0.0-00010101000000-000000000000
+
+require (
+	go.etcd.io/bbolt v1.4.3 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+)
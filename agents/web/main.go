@@ -0,0 +1,378 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// Agent implementation for web visitors via json api and an embedded chat page
+
+type Config struct {
+	// address of the http server, e.g. :8082
+	Listen string
+	// message sent on behalf of a new visitor, e.g. the start command of the survey
+	// nothing is sent if empty
+	Start string
+	// serve https with these files, plain http if empty (when tls is terminated by a reverse proxy)
+	CertFile string
+	KeyFile  string
+}
+
+const (
+	tokenBytes = 16
+	// visitors idle for longer have to start over
+	sessionTTL = 24 * time.Hour
+	// least recently seen visitor is forgotten to make room for a new one
+	maxVisitors = 10000
+	// sessions one address can create within the window, so a script cant push out everyone,
+	// behind a reverse proxy all visitors share its address
+	sessionsPerAddress = 20
+	sessionWindow      = time.Minute
+	// how long a request waits for the replies to its message
+	replyTimeout     = 30 * time.Second
+	maxMessageLength = 4096
+)
+
+//go:embed index.html
+var page []byte
+
+type Agent struct {
+	config Config
+
+	mu sync.Mutex
+	// token -> last time the visitor sent something
+	visitors map[string]time.Time
+	// remote address -> sessions it created in the current window
+	created map[string]*createdSessions
+
+	incoming chan *Update
+	stopped  chan struct{}
+}
+
+func NewBot(config Config, l *log.Logger) (conversation.Agent, error) {
+	setLogger(l)
+	if config.Listen == "" {
+		return nil, fmt.Errorf("web listen address is required")
+	}
+	return &Agent{
+		config:   config,
+		visitors: make(map[string]time.Time),
+		created:  make(map[string]*createdSessions),
+		incoming: make(chan *Update),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+type Logger interface {
+	Println(v ...interface{})
+}
+
+var logger Logger = log.Default()
+
+func setLogger(l Logger) error {
+	if l == nil {
+		return fmt.Errorf("empty logger provided")
+	}
+	logger = l
+	return nil
+}
+
+type button struct {
+	Text  string `json:"text"`
+	Style string `json:"style,omitempty"`
+}
+
+// keyboard replaces the buttons on the page, they stay if it is empty unless remove_keyboard is set
+type message struct {
+	Text           string     `json:"text"`
+	Keyboard       [][]button `json:"keyboard,omitempty"`
+	RemoveKeyboard bool       `json:"remove_keyboard,omitempty"`
+}
+
+type sessionResponse struct {
+	Token    string    `json:"token"`
+	Messages []message `json:"messages"`
+}
+
+type messageRequest struct {
+	Token string `json:"token"`
+	Text  string `json:"text"`
+}
+
+type messageResponse struct {
+	Messages []message `json:"messages"`
+}
+
+// chat page and json api:
+// POST /api/session - new visitor, returns its token and replies to the start message
+// POST /api/message - {"token", "text"}, returns replies to the message
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+	mux.HandleFunc("POST /api/session", func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowSession(r.RemoteAddr) {
+			http.Error(w, "too many sessions", http.StatusTooManyRequests)
+			return
+		}
+		token, err := a.newVisitor()
+		if err != nil {
+			logger.Println("cant create session: ", err.Error())
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		resp := sessionResponse{Token: token, Messages: []message{}}
+		if a.config.Start != "" {
+			messages, ok := a.send(w, r, token, a.config.Start)
+			if !ok {
+				return
+			}
+			resp.Messages = messages
+		}
+		writeJSON(w, resp)
+	})
+	mux.HandleFunc("POST /api/message", func(w http.ResponseWriter, r *http.Request) {
+		var req messageRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*maxMessageLength)).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Text) > maxMessageLength {
+			http.Error(w, "message is too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !a.touch(req.Token) {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		if messages, ok := a.send(w, r, req.Token, req.Text); ok {
+			writeJSON(w, messageResponse{Messages: messages})
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Println("cant write response: ", err.Error())
+	}
+}
+
+func (a *Agent) newVisitor() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for t, seen := range a.visitors {
+		if now.Sub(seen) > sessionTTL {
+			delete(a.visitors, t)
+		}
+	}
+	if len(a.visitors) >= maxVisitors {
+		oldest, oldestSeen := "", now
+		for t, seen := range a.visitors {
+			if seen.Before(oldestSeen) {
+				oldest, oldestSeen = t, seen
+			}
+		}
+		delete(a.visitors, oldest)
+	}
+	a.visitors[token] = now
+	return token, nil
+}
+
+type createdSessions struct {
+	since time.Time
+	count int
+}
+
+// false if the address created too many sessions lately
+func (a *Agent) allowSession(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for addr, c := range a.created {
+		if now.Sub(c.since) > sessionWindow {
+			delete(a.created, addr)
+		}
+	}
+	c, found := a.created[host]
+	if !found {
+		c = &createdSessions{since: now}
+		a.created[host] = c
+	}
+	if c.count >= sessionsPerAddress {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// false if the token is unknown or expired
+func (a *Agent) touch(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seen, found := a.visitors[token]
+	if !found || time.Since(seen) > sessionTTL {
+		delete(a.visitors, token)
+		return false
+	}
+	a.visitors[token] = time.Now()
+	return true
+}
+
+// passes the message to the manager and waits until it is handled
+// writes an error response and returns false on failure
+func (a *Agent) send(w http.ResponseWriter, r *http.Request, token string, text string) ([]message, bool) {
+	update := newUpdate(token, text)
+	select {
+	case a.incoming <- update:
+	case <-a.stopped:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+	select {
+	case <-update.done:
+		return update.replies(), true
+	case <-time.After(replyTimeout):
+		http.Error(w, "no reply in time", http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+	return nil, false
+}
+
+func (a *Agent) Run(ctx context.Context) (chan conversation.Update, error) {
+	stopped, err := conversation.Serve(ctx, "web", a.config.Listen, a.config.CertFile, a.config.KeyFile, a.Handler())
+	if err != nil {
+		return nil, err
+	}
+	updates := make(chan conversation.Update)
+
+	go func() {
+		// requests in flight are finished and their updates handled by then
+		<-stopped
+		close(a.stopped)
+	}()
+	go func() {
+		defer close(updates)
+		for {
+			select {
+			case update := <-a.incoming:
+				updates <- update
+			case <-a.stopped:
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+type Update struct {
+	token string
+	text  string
+
+	mu       sync.Mutex
+	messages []message
+	done     chan struct{}
+}
+
+func newUpdate(token string, text string) *Update {
+	return &Update{
+		token:    token,
+		text:     text,
+		messages: []message{},
+		done:     make(chan struct{}),
+	}
+}
+
+func (upd *Update) Provider() string { return "web" }
+
+func (upd *Update) ChatID() string {
+	return fmt.Sprint("web", upd.token)
+}
+
+// visitors are anonymous
+func (upd *Update) GetSender() conversation.User {
+	return conversation.User{Id: upd.token}
+}
+
+func (upd *Update) GetMessage() string {
+	return upd.text
+}
+
+// only text is supported
+func (upd *Update) GetAttachments() []conversation.Attachment {
+	return nil
+}
+
+// browsers dont give the phone number, see conversation.ContactSharing
+func (upd *Update) CanShareContact() bool {
+	return false
+}
+
+func (upd *Update) Reply(text string) error {
+	return upd.ReplyWithKeyboard(text, conversation.Keyboard{})
+}
+
+func (upd *Update) ReplyWithKeyboard(text string, kb conversation.Keyboard) error {
+	msg := message{Text: conversation.ParseMarkup(text).Plain()}
+	for _, row := range kb.Rows {
+		buttons := make([]button, 0, len(row))
+		for _, b := range row {
+			buttons = append(buttons, button{Text: b.Text, Style: string(b.Style)})
+		}
+		if len(buttons) > 0 {
+			msg.Keyboard = append(msg.Keyboard, buttons)
+		}
+	}
+	upd.add(msg)
+	return nil
+}
+
+func (upd *Update) ReplyRemovingKeyboard(text string) error {
+	upd.add(message{Text: conversation.ParseMarkup(text).Plain(), RemoveKeyboard: true})
+	return nil
+}
+
+func (upd *Update) add(msg message) {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	upd.messages = append(upd.messages, msg)
+}
+
+// called by the manager once the update is handled
+func (upd *Update) Complete() {
+	close(upd.done)
+}
+
+func (upd *Update) replies() []message {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	return upd.messages
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAgent(t *testing.T) *Agent {
+	t.Helper()
+	agent, err := NewBot(Config{Listen: ":0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := agent.(*Agent)
+	// echoes every message as the manager would reply
+	go func() {
+		for update := range a.incoming {
+			update.Reply("echo: " + update.GetMessage())
+			update.Complete()
+		}
+	}()
+	t.Cleanup(func() { close(a.incoming) })
+	return a
+}
+
+func post(a *Agent, path, body, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func newSession(t *testing.T, a *Agent) string {
+	t.Helper()
+	w := post(a, "/api/session", "", "192.0.2.1:1234")
+	var resp sessionResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil || resp.Token == "" {
+		t.Fatalf("got %d %s, want a session", w.Code, w.Body)
+	}
+	return resp.Token
+}
+
+func TestMessages(t *testing.T) {
+	a := newTestAgent(t)
+	token := newSession(t, a)
+
+	w := post(a, "/api/message", fmt.Sprintf(`{"token":%q,"text":"hi"}`, token), "192.0.2.1:1234")
+	var resp messageResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Messages) != 1 || resp.Messages[0].Text != "echo: hi" {
+		t.Errorf("got %d %s, want the reply", w.Code, w.Body)
+	}
+
+	if w := post(a, "/api/message", `{"token":"unknown","text":"hi"}`, "192.0.2.1:1234"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for unknown token, want 404", w.Code)
+	}
+	a.visitors[token] = time.Now().Add(-sessionTTL - time.Minute)
+	if w := post(a, "/api/message", fmt.Sprintf(`{"token":%q,"text":"hi"}`, token), "192.0.2.1:1234"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for expired token, want 404", w.Code)
+	}
+	if w := post(a, "/api/message", `{"token":`, "192.0.2.1:1234"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for bad json, want 400", w.Code)
+	}
+}
+
+func TestFullAgentForgetsOldestVisitor(t *testing.T) {
+	a := newTestAgent(t)
+	now := time.Now()
+	for i := range maxVisitors {
+		a.visitors[fmt.Sprint("visitor", i)] = now.Add(-time.Hour + time.Duration(i)*time.Millisecond)
+	}
+	token := newSession(t, a)
+	if len(a.visitors) != maxVisitors {
+		t.Errorf("got %d visitors, want %d", len(a.visitors), maxVisitors)
+	}
+	if _, found := a.visitors["visitor0"]; found {
+		t.Error("least recently seen visitor is kept")
+	}
+	if _, found := a.visitors[token]; !found {
+		t.Error("new visitor is not added")
+	}
+}
+
+func TestSessionsAreLimitedPerAddress(t *testing.T) {
+	a := newTestAgent(t)
+	for range sessionsPerAddress {
+		newSession(t, a)
+	}
+	if w := post(a, "/api/session", "", "192.0.2.1:5678"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want 429", w.Code)
+	}
+	if w := post(a, "/api/session", "", "192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("got %d for another address, want 200", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package conversation
+
+import "slices"
+
+const DefaultAttachmentMessage = "Пожалуйста, ответьте текстом."
+
+type AttachmentType string
+
+const (
+	PhotoAttachment    AttachmentType = "photo"
+	DocumentAttachment AttachmentType = "document"
+	VoiceAttachment    AttachmentType = "voice"
+	AudioAttachment    AttachmentType = "audio"
+	VideoAttachment    AttachmentType = "video"
+	StickerAttachment  AttachmentType = "sticker"
+	ContactAttachment  AttachmentType = "contact"
+	// anything the agent doesnt know how to describe
+	OtherAttachment AttachmentType = "other"
+)
+
+// file or contact sent along with the message
+type Attachment struct {
+	Type AttachmentType
+	// id of the file on the platform, e.g. tg file_id, enough to download it later
+	ID string
+	// direct link to the file if the platform gives one
+	URL string
+	// original file name of documents
+	Name string
+	// phone number of the shared contact
+	Phone string
+	// contact is the sender's own, e.g. shared with the contact button
+	Verified bool
+}
+
+// reference to store instead of the file: link if there is one, type and id otherwise
+func (a Attachment) String() string {
+	switch {
+	case a.Type == ContactAttachment:
+		return a.Phone
+	case a.URL != "":
+		return a.URL
+	}
+	return string(a.Type) + ":" + a.ID
+}
+
+// first contact with a phone number among the attachments
+func SharedContact(attachments []Attachment) (Attachment, bool) {
+	for _, a := range attachments {
+		if a.Type == ContactAttachment && a.Phone != "" {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// attachments a stage accepts
+type AttachmentPolicy struct {
+	// attachments are rejected unless set
+	Accept bool
+	// accepted types, any if empty
+	Types []AttachmentType
+	// answer without attachments is rejected
+	Required bool
+	// shown when the message doesnt fit the policy
+	Message string
+}
+
+func RejectAttachments(message string) AttachmentPolicy {
+	return AttachmentPolicy{Message: message}
+}
+
+func (p AttachmentPolicy) check(attachments []Attachment) bool {
+	if len(attachments) == 0 {
+		return !p.Required
+	}
+	if !p.Accept {
+		return false
+	}
+	for _, a := range attachments {
+		if len(p.Types) > 0 && !slices.Contains(p.Types, a.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// runs next only if attachments of the message fit the policy, otherwise replies with the message
+// handler stays on the same stage so the question is asked again, same as ValidateAction
+func AttachmentsAction(policy AttachmentPolicy, next Action) Action {
+	return func(answer string, ctx Ctx) error {
+		if !policy.check(ctx.Update().GetAttachments()) {
+			return ctx.Update().Reply(policy.Message)
+		}
+		return next(answer, ctx)
+	}
+}
+
+// saves references to the attachments of the message, see Attachment.String
+func SaveAttachmentsAction(key string, next Action) Action {
+	return func(answer string, ctx Ctx) error {
+		attachments := ctx.Update().GetAttachments()
+		refs := make([]string, len(attachments))
+		for i, a := range attachments {
+			refs[i] = a.String()
+		}
+		ctx.SetKey(key, refs)
+		return next(answer, ctx)
+	}
+}
+
+// references saved by SaveAttachmentsAction, they come back as []interface{} from a stored session
+func AttachmentRefs(value interface{}) []string {
+	switch refs := value.(type) {
+	case []string:
+		return refs
+	case []interface{}:
+		result := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			if s, ok := ref.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StageCodec converts handlers to bytes and back so the stage of a session
+// can outlive the process
+type StageCodec interface {
+	EncodeStage(handler Handler) ([]byte, error)
+	DecodeStage(data []byte) (Handler, error)
+}
+
+var sessionsBucket = []byte("sessions")
+
+type storedSession struct {
+	Stage   json.RawMessage `json:"stage,omitempty"`
+	History []storedEntry   `json:"history,omitempty"`
+	Keys    keystorage      `json:"keys"`
+}
+
+type storedEntry struct {
+	Stage json.RawMessage `json:"stage"`
+	Call  bool            `json:"call,omitempty"`
+}
+
+// file-backed store on top of an embedded bolt database
+// without a codec only keys are persisted and the stage and history start over after a restart
+type BoltStore struct {
+	db    *bolt.DB
+	codec StageCodec
+}
+
+func NewBoltStore(path string, codec StageCodec) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cant open session store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		db:    db,
+		codec: codec,
+	}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Load(chatID string) (*Session, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(sessionsBucket).Get([]byte(chatID)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var stored storedSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("corrupted session %s: %w", chatID, err)
+	}
+	sess := newSession()
+	if stored.Keys != nil {
+		sess.KeyStorage = stored.Keys
+	}
+	if s.codec != nil && len(stored.Stage) > 0 {
+		handler, err := s.codec.DecodeStage(stored.Stage)
+		if err != nil {
+			return nil, fmt.Errorf("cant restore stage of session %s: %w", chatID, err)
+		}
+		sess.Handler = handler
+		for _, entry := range stored.History {
+			stage, err := s.codec.DecodeStage(entry.Stage)
+			if err != nil {
+				return nil, fmt.Errorf("cant restore history of session %s: %w", chatID, err)
+			}
+			sess.History = append(sess.History, HistoryEntry{Stage: stage, Call: entry.Call})
+		}
+	}
+	return sess, nil
+}
+
+func (s *BoltStore) Save(chatID string, sess *Session) error {
+	stored := storedSession{Keys: sess.KeyStorage}
+	if s.codec != nil && sess.Handler != nil {
+		stage, err := s.codec.EncodeStage(sess.Handler)
+		if err != nil {
+			return fmt.Errorf("cant save stage of session %s: %w", chatID, err)
+		}
+		stored.Stage = stage
+		for _, entry := range sess.History {
+			stage, err := s.codec.EncodeStage(entry.Stage)
+			if err != nil {
+				return fmt.Errorf("cant save history of session %s: %w", chatID, err)
+			}
+			stored.History = append(stored.History, storedEntry{Stage: stage, Call: entry.Call})
+		}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(chatID), data)
+	})
+}
+
+func (s *BoltStore) Delete(chatID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(chatID))
+	})
+}
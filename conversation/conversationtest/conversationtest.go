@@ -0,0 +1,247 @@
+// Package conversationtest runs a conversation.Manager against a fake agent
+// so conversations can be scripted in tests without tg or vk.
+package conversationtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+const Provider = "test"
+
+// how long Send waits for the manager to handle a message
+const replyTimeout = 5 * time.Second
+
+// same as the sender of recorded transcripts so they can be replayed
+var DefaultSender = conversation.AnonymousUser
+
+// message sent by the bot
+type Reply struct {
+	Text     string
+	Keyboard conversation.Keyboard
+	// reply hides the keyboard the user sees
+	RemoveKeyboard bool
+}
+
+// texts of the buttons row by row
+func (r Reply) Options() []string {
+	options := []string{}
+	for _, row := range r.Keyboard.Rows {
+		for _, button := range row {
+			options = append(options, button.Text)
+		}
+	}
+	return options
+}
+
+// fake agent, messages are sent with Send and replies of the bot are recorded
+type Agent struct {
+	Sender conversation.User
+
+	incoming chan *Update
+}
+
+func NewAgent() *Agent {
+	return &Agent{
+		Sender:   DefaultSender,
+		incoming: make(chan *Update),
+	}
+}
+
+func (a *Agent) Run(ctx context.Context) (chan conversation.Update, error) {
+	updates := make(chan conversation.Update)
+	go func() {
+		defer close(updates)
+		for {
+			select {
+			case update := <-a.incoming:
+				updates <- update
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// sends text to the chat and returns the replies once the manager handled it
+func (a *Agent) Send(chatID string, text string) ([]Reply, error) {
+	return a.send(NewUpdate(chatID, text, a.Sender))
+}
+
+// same as Send for a message with files or a contact
+func (a *Agent) SendAttachments(chatID string, text string, attachments ...conversation.Attachment) ([]Reply, error) {
+	update := NewUpdate(chatID, text, a.Sender)
+	update.attachments = attachments
+	return a.send(update)
+}
+
+func (a *Agent) send(update *Update) ([]Reply, error) {
+	select {
+	case a.incoming <- update:
+	case <-time.After(replyTimeout):
+		return nil, fmt.Errorf("manager is not running")
+	}
+	select {
+	case <-update.done:
+		return update.Replies(), nil
+	case <-time.After(replyTimeout):
+		return nil, fmt.Errorf("message %q was not handled in %s", update.text, replyTimeout)
+	}
+}
+
+// runs manager with a fake agent until the test ends
+func Start(t testing.TB, manager *conversation.Manager) *Agent {
+	t.Helper()
+	agent := NewAgent()
+	manager.AddAgent(agent)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- manager.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("manager stopped with error: %v", err)
+		}
+	})
+	return agent
+}
+
+// update recording the replies, can be passed to handlers directly
+type Update struct {
+	provider string
+	chatID   string
+	text     string
+	sender   conversation.User
+	// set by SendAttachments
+	attachments []conversation.Attachment
+
+	mu      sync.Mutex
+	replies []Reply
+	done    chan struct{}
+}
+
+func NewUpdate(chatID string, text string, sender conversation.User) *Update {
+	return &Update{
+		provider: Provider,
+		chatID:   chatID,
+		text:     text,
+		sender:   sender,
+		done:     make(chan struct{}),
+	}
+}
+
+func (upd *Update) Provider() string             { return upd.provider }
+func (upd *Update) ChatID() string               { return upd.chatID }
+func (upd *Update) GetSender() conversation.User { return upd.sender }
+func (upd *Update) GetMessage() string           { return upd.text }
+func (upd *Update) GetAttachments() []conversation.Attachment {
+	return upd.attachments
+}
+
+func (upd *Update) Reply(text string) error {
+	return upd.ReplyWithKeyboard(text, conversation.Keyboard{})
+}
+
+func (upd *Update) ReplyWithKeyboard(text string, kb conversation.Keyboard) error {
+	upd.record(Reply{Text: text, Keyboard: kb})
+	return nil
+}
+
+func (upd *Update) ReplyRemovingKeyboard(text string) error {
+	upd.record(Reply{Text: text, RemoveKeyboard: true})
+	return nil
+}
+
+func (upd *Update) record(reply Reply) {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	upd.replies = append(upd.replies, reply)
+}
+
+func (upd *Update) Complete() {
+	close(upd.done)
+}
+
+func (upd *Update) Replies() []Reply {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	return append([]Reply(nil), upd.replies...)
+}
+
+// one exchange of a script: user says Say and the bot answers
+type Step struct {
+	Say string
+	// sent along with Say
+	Attach []conversation.Attachment
+	// text of the last reply, not checked if empty
+	Expect string
+	// part of the text of any reply, not checked if empty
+	Contains string
+	// buttons of the last reply, not checked if nil
+	Options []string
+	// last reply hides the keyboard, not checked if false
+	RemovesKeyboard bool
+}
+
+type Script []Step
+
+// plays script in the chat, the test fails at the first step the bot answers differently
+func (a *Agent) Play(t testing.TB, chatID string, script Script) {
+	t.Helper()
+	for i, step := range script {
+		replies, err := a.SendAttachments(chatID, step.Say, step.Attach...)
+		if err != nil {
+			t.Fatalf("step %d %q: %v", i+1, step.Say, err)
+		}
+		if err := step.check(replies); err != nil {
+			t.Fatalf("step %d %q: %v\nreplies:\n%s", i+1, step.Say, err, format(replies))
+		}
+	}
+}
+
+func (step Step) check(replies []Reply) error {
+	if len(replies) == 0 {
+		if step.Expect != "" || step.Contains != "" || step.Options != nil || step.RemovesKeyboard {
+			return fmt.Errorf("no replies")
+		}
+		return nil
+	}
+	last := replies[len(replies)-1]
+	if step.Expect != "" && last.Text != step.Expect {
+		return fmt.Errorf("expected %q, got %q", step.Expect, last.Text)
+	}
+	if step.Contains != "" {
+		found := false
+		for _, reply := range replies {
+			found = found || strings.Contains(reply.Text, step.Contains)
+		}
+		if !found {
+			return fmt.Errorf("expected a reply containing %q", step.Contains)
+		}
+	}
+	if step.Options != nil && !reflect.DeepEqual(last.Options(), step.Options) {
+		return fmt.Errorf("expected options %q, got %q", step.Options, last.Options())
+	}
+	if step.RemovesKeyboard && !last.RemoveKeyboard {
+		return fmt.Errorf("expected the keyboard to be removed")
+	}
+	return nil
+}
+
+func format(replies []Reply) string {
+	var b strings.Builder
+	for _, reply := range replies {
+		fmt.Fprintf(&b, "  %q %q\n", reply.Text, reply.Options())
+	}
+	return b.String()
+}
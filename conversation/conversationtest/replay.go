@@ -0,0 +1,112 @@
+package conversationtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+// set to 1 to rewrite transcripts with the current answers of the bot instead of comparing
+const UpdateEnv = "UPDATE_TRANSCRIPTS"
+
+// replays transcript recorded by conversation.RecordingMiddleware against manager,
+// the test fails at the first update the bot answers differently
+// changed texts or flow have to be recorded again with UPDATE_TRANSCRIPTS=1
+// and the diff of the transcript reviewed
+func Replay(t testing.TB, manager *conversation.Manager, path string) {
+	t.Helper()
+	want, err := ReadTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded bytes.Buffer
+	manager.Use(conversation.RecordingMiddleware(&recorded))
+	agent := Start(t, manager)
+	for i, entry := range want {
+		update := NewUpdate(entry.Chat, entry.Say, agent.Sender)
+		update.provider = entry.Provider
+		for _, kind := range entry.Attachments {
+			update.attachments = append(update.attachments, conversation.Attachment{Type: kind, ID: "test"})
+		}
+		if _, err := agent.send(update); err != nil {
+			t.Fatalf("%s:%d: %v", path, i+1, err)
+		}
+	}
+
+	got, err := readEntries(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%s: recorded %d updates, want %d", path, len(got), len(want))
+	}
+	// updates are replayed one by one, so recorded chats follow the transcript
+	for i := range got {
+		got[i].Chat = want[i].Chat
+	}
+	if os.Getenv(UpdateEnv) == "1" {
+		if err := WriteTranscript(path, got); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Fatalf("%s:%d: bot answered %q differently\nwant: %s\n got: %s", path, i+1, want[i].Say, marshal(want[i]), marshal(got[i]))
+		}
+	}
+}
+
+func ReadTranscript(path string) ([]conversation.TranscriptEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := readEntries(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+func WriteTranscript(path string, entries []conversation.TranscriptEntry) error {
+	var b bytes.Buffer
+	for _, entry := range entries {
+		b.Write(marshal(entry))
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+func readEntries(r io.Reader) ([]conversation.TranscriptEntry, error) {
+	entries := []conversation.TranscriptEntry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry conversation.TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.Replies == nil {
+			entry.Replies = []conversation.TranscriptReply{}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func marshal(entry conversation.TranscriptEntry) []byte {
+	data, _ := json.Marshal(entry)
+	return data
+}
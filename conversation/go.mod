@@ -1,3 +1,10 @@
 module github.com/spanditime/go-survey-bot/conversation
 
 go 1.24.5
+
+require (
+	go.etcd.io/bbolt v1.4.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.29.0 // indirect
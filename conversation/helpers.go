@@ -1,4 +1,7 @@
 package conversation
+
+import "slices"
+
 // conversation handler with predefined options
 type Action = func(text string, ctx Ctx) error
 type Stage = func() Handler
@@ -7,16 +10,18 @@ type StageCtx = func(answer string, ctx Ctx) Handler
 func EmptyAction() Action { return func(answer string, ctx Ctx) error { return nil } }
 func SendTextAction(text string, next Action) Action {
 	return func(answer string, ctx Ctx) error {
-		ctx.Update().Reply(text)
-		next(answer, ctx)
-		return nil
+		if err := ctx.Update().Reply(text); err != nil {
+			return err
+		}
+		return next(answer, ctx)
 	}
 }
-func SendTextWithKeyboardAction(text string, keyboard []string, next Action) Action {
+func SendTextWithKeyboardAction(text string, keyboard Keyboard, next Action) Action {
 	return func(answer string, ctx Ctx) error {
-		ctx.Update().ReplyWithKeyboard(text, keyboard)
-		next(answer, ctx)
-		return nil
+		if err := ctx.Update().ReplyWithKeyboard(text, keyboard); err != nil {
+			return err
+		}
+		return next(answer, ctx)
 	}
 }
 func TransitionStageAction(next Stage) Action {
@@ -32,6 +37,24 @@ func TransitionStageActionCtx(next StageCtx) Action {
 	}
 }
 
+// goes back to the previous stage, stays on the current one if there is none
+func BackAction() Action {
+	return func(answer string, ctx Ctx) error {
+		ctx.Back()
+		return nil
+	}
+}
+
+// returns to the stage that called current one, runs next if it was not called
+func ReturnAction(next Action) Action {
+	return func(answer string, ctx Ctx) error {
+		if ctx.Return() {
+			return nil
+		}
+		return next(answer, ctx)
+	}
+}
+
 func SaveKeyAction(key string, next Action) Action {
 	return func(answer string, ctx Ctx) error {
 		ctx.SetKey(key, answer)
@@ -53,8 +76,9 @@ func NewAnswerHandler(welcome Action, question string, answerHandler Action) Han
 	}
 }
 
+// free text answer, buttons of the previous stages would be taken for options
 func (handler *AnswerHandler) sendQuestion(ctx Ctx) error {
-	return ctx.Update().Reply(handler.question)
+	return ctx.Update().ReplyRemovingKeyboard(handler.question)
 }
 func (handler *AnswerHandler) Welcome(ctx Ctx) error {
 	err := handler.welcome("", ctx)
@@ -66,26 +90,59 @@ func (handler *AnswerHandler) Welcome(ctx Ctx) error {
 
 func (handler *AnswerHandler) Handle(ctx Ctx) error {
 	var answer string = ctx.Update().GetMessage()
-	return handler.answerHandler(answer, ctx)
+	if err := handler.answerHandler(answer, ctx); err != nil {
+		return err
+	}
+	// answer was not accepted - ask again
+	if !ctx.Finalized() && !ctx.Transitioning() {
+		return handler.sendQuestion(ctx)
+	}
+	return nil
 }
 
-type OptionsHandlers map[string]Action
+// predefined answer shown as a button
+type Option struct {
+	Text           string
+	Style          ButtonStyle
+	RequestContact bool
+	Action         Action
+}
+
+// options in the order they are shown
+type OptionsHandlers []Option
+
+// first option with the text
+func (handlers OptionsHandlers) Find(text string) (Option, bool) {
+	for _, option := range handlers {
+		if option.Text == text {
+			return option, true
+		}
+	}
+	return Option{}, false
+}
 
-func (handlers *OptionsHandlers) Options() []string {
-	keys := make([]string, len(*handlers))
-	i := 0
-	for k := range *handlers {
-		keys[i] = k
-		i++
+// buttons of the options, duplicates are shown once
+func (handlers OptionsHandlers) Buttons() []Button {
+	buttons := make([]Button, 0, len(handlers))
+	seen := make(map[string]bool, len(handlers))
+	for _, option := range handlers {
+		if seen[option.Text] {
+			continue
+		}
+		seen[option.Text] = true
+		buttons = append(buttons, Button{Text: option.Text, Style: option.Style, RequestContact: option.RequestContact})
 	}
-	return keys
+	return buttons
 }
 
 type OptionsHandler struct {
 	welcome        Action
 	optionHandlers OptionsHandlers
+	layout         Layout
 	question       string
 	answerHandler  Action
+	// checked before the options, nil accepts anything
+	attachments *AttachmentPolicy
 }
 
 func NewOptionsHandler(welcome Action, question string, handlers OptionsHandlers, answerHandler Action) *OptionsHandler {
@@ -97,14 +154,36 @@ func NewOptionsHandler(welcome Action, question string, handlers OptionsHandlers
 	}
 }
 
+// sets how options are placed on the keyboard, one per row by default
+func (handler *OptionsHandler) SetLayout(layout Layout) *OptionsHandler {
+	handler.layout = layout
+	return handler
+}
+
+// files sent with an option are checked against the policy before it,
+// a photo captioned like an option is not taken for that option
+func (handler *OptionsHandler) SetAttachmentPolicy(policy AttachmentPolicy) *OptionsHandler {
+	handler.attachments = &policy
+	return handler
+}
+
+// every question shows exactly its own options, no options hide the previous ones
 func (handler *OptionsHandler) sendQuestion(ctx Ctx) error {
-	return SendTextWithKeyboardAction(handler.question, handler.optionHandlers.Options(), EmptyAction())("", ctx)
+	buttons := handler.optionHandlers.Buttons()
+	if !CanShareContact(ctx.Update()) {
+		buttons = slices.DeleteFunc(buttons, func(b Button) bool { return b.RequestContact })
+	}
+	keyboard := handler.layout.Keyboard(buttons)
+	if keyboard.Empty() {
+		return ctx.Update().ReplyRemovingKeyboard(handler.question)
+	}
+	return SendTextWithKeyboardAction(handler.question, keyboard, EmptyAction())("", ctx)
 }
 
 func (handler *OptionsHandler) handleOption(option string, ctx Ctx) error {
 	var err error
-	if h, found := handler.optionHandlers[option]; found {
-		err = h(option, ctx)
+	if h, found := handler.optionHandlers.Find(option); found {
+		err = h.Action(option, ctx)
 	} else {
 		err = handler.answerHandler(option, ctx)
 	}
@@ -113,6 +192,13 @@ func (handler *OptionsHandler) handleOption(option string, ctx Ctx) error {
 
 func (handler *OptionsHandler) Handle(ctx Ctx) error {
 	var answer string = ctx.Update().GetMessage()
+	// messages without files still reach the options, e.g. back from a question requiring them
+	if attachments := ctx.Update().GetAttachments(); handler.attachments != nil && len(attachments) > 0 && !handler.attachments.check(attachments) {
+		if err := ctx.Update().Reply(handler.attachments.Message); err != nil {
+			return err
+		}
+		return handler.sendQuestion(ctx)
+	}
 	if err := handler.handleOption(answer, ctx); err != nil {
 		return err
 	}
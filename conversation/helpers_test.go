@@ -0,0 +1,56 @@
+package conversation_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+	"github.com/spanditime/go-survey-bot/conversation/conversationtest"
+)
+
+func TestQuestionsShowOnlyTheirOptions(t *testing.T) {
+	var name, color conversation.Stage
+	name = func() conversation.Handler {
+		return conversation.NewAnswerHandler(conversation.EmptyAction(), "Name?", conversation.TransitionStageAction(color))
+	}
+	color = func() conversation.Handler {
+		options := conversation.OptionsHandlers{{Text: "Red", Action: conversation.TransitionStageAction(name)}}
+		return conversation.NewOptionsHandler(conversation.EmptyAction(), "Color?", options, conversation.TransitionStageAction(name))
+	}
+	agent := conversationtest.Start(t, conversation.NewManager(name))
+	agent.Play(t, "chat", conversationtest.Script{
+		// welcome of the first stage is followed by handling of the message
+		{Say: "Ann", Contains: "Name?", Expect: "Color?", Options: []string{"Red"}},
+		{Say: "Red", Expect: "Name?", RemovesKeyboard: true},
+		{Say: "Bob", Expect: "Color?", Options: []string{"Red"}},
+	})
+}
+
+// update of a platform without the contact button
+type contactlessUpdate struct {
+	*conversationtest.Update
+}
+
+func (contactlessUpdate) CanShareContact() bool { return false }
+
+func TestContactButtonNeedsThePlatform(t *testing.T) {
+	options := conversation.OptionsHandlers{
+		{Text: "Share phone", RequestContact: true, Action: conversation.EmptyAction()},
+		{Text: "Back", Action: conversation.EmptyAction()},
+	}
+	handler := conversation.NewOptionsHandler(conversation.EmptyAction(), "Phone?", options, conversation.EmptyAction())
+
+	tg := conversationtest.NewUpdate("chat", "", conversationtest.DefaultSender)
+	web := conversationtest.NewUpdate("chat", "", conversationtest.DefaultSender)
+	for _, update := range []conversation.Update{tg, contactlessUpdate{web}} {
+		if err := handler.Welcome(conversation.WithUpdate(nil, update)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := tg.Replies()[0].Options(); !slices.Equal(got, []string{"Share phone", "Back"}) {
+		t.Errorf("got options %q on a platform with the contact button", got)
+	}
+	if got := web.Replies()[0].Options(); !slices.Equal(got, []string{"Back"}) {
+		t.Errorf("got options %q on a platform without the contact button", got)
+	}
+}
@@ -0,0 +1,80 @@
+package conversation
+
+// keyboard shown under a message, agents render it as close as the platform allows
+type Keyboard struct {
+	Rows [][]Button
+	// hide keyboard after a button was pressed
+	OneTime bool
+	// keep keyboard visible even when user opens the system keyboard (tg only)
+	Persistent bool
+	// attach keyboard to the message instead of replacing the user's keyboard
+	Inline bool
+}
+
+type ButtonStyle string
+
+// colors of vk buttons, ignored by tg
+const (
+	DefaultButton  ButtonStyle = ""
+	PrimaryButton  ButtonStyle = "primary"
+	PositiveButton ButtonStyle = "positive"
+	NegativeButton ButtonStyle = "negative"
+)
+
+type Button struct {
+	Text  string
+	Style ButtonStyle
+	// button shares the phone number of the user as a contact attachment
+	// agents that cant do it send the text of the button
+	RequestContact bool
+}
+
+func (kb Keyboard) Empty() bool {
+	for _, row := range kb.Rows {
+		if len(row) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (kb Keyboard) RequestsContact() bool {
+	for _, row := range kb.Rows {
+		for _, b := range row {
+			if b.RequestContact {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// how buttons are placed on the keyboard
+type Layout struct {
+	// number of buttons in each row, the last value is used for the rest of the buttons
+	// one button per row if empty
+	Rows       []int
+	OneTime    bool
+	Persistent bool
+	Inline     bool
+}
+
+// places buttons in rows by the layout
+func (l Layout) Keyboard(buttons []Button) Keyboard {
+	kb := Keyboard{
+		Rows:       make([][]Button, 0, len(buttons)),
+		OneTime:    l.OneTime,
+		Persistent: l.Persistent,
+		Inline:     l.Inline,
+	}
+	for i, row := 0, 0; i < len(buttons); row++ {
+		size := 1
+		if len(l.Rows) > 0 {
+			size = l.Rows[min(row, len(l.Rows)-1)]
+		}
+		size = max(1, min(size, len(buttons)-i))
+		kb.Rows = append(kb.Rows, buttons[i:i+size])
+		i += size
+	}
+	return kb
+}
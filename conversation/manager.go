@@ -1,6 +1,7 @@
 package conversation
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -24,12 +25,51 @@ type Update interface {
 	ChatID() string
 	GetSender() User
 	GetMessage() string
+	// files and contacts sent with the message, text of the message is its caption
+	GetAttachments() []Attachment
+	// text is markup, see ParseMarkup
+	// the keyboard the user sees stays
 	Reply(text string) error
-	ReplyWithKeyboard(text string, kb []string) error
+	// the keyboard replaces the one the user sees and the buttons of the previous inline message,
+	// empty keyboard keeps them as Reply does
+	ReplyWithKeyboard(text string, kb Keyboard) error
+	// hides the keyboard the user sees and the buttons of the previous inline message
+	ReplyRemovingKeyboard(text string) error
 }
 
+// optional interface of updates that need to know when handling is over,
+// e.g. to answer an http request with all the replies at once
+type Completer interface {
+	Complete()
+}
+
+// optional interface of updates from platforms with group chats,
+// agents key group sessions by chat and sender so members dont share one conversation
+type GroupUpdate interface {
+	// message comes from a chat with other people
+	InGroup() bool
+	// message is a command, mentions the bot, replies to it or presses its button
+	Addressed() bool
+}
+
+// optional interface of updates from platforms without a button sharing the contact of the user,
+// such buttons are left out of their keyboards
+type ContactSharing interface {
+	CanShareContact() bool
+}
+
+// whether the keyboard can have buttons requesting the contact, see ContactSharing
+func CanShareContact(update Update) bool {
+	if sharing, ok := update.(ContactSharing); ok {
+		return sharing.CanShareContact()
+	}
+	return true
+}
+
+// agent receives updates until ctx is done, then it closes the channel
+// once no more updates are going to be sent
 type Agent interface {
-	Run() (chan Update, error)
+	Run(ctx context.Context) (chan Update, error)
 }
 
 type Handler interface {
@@ -39,25 +79,39 @@ type Handler interface {
 
 type keystorage = map[string]interface{}
 
-type session struct {
-	Handler    Handler
-	KeyStorage keystorage
-}
+const DefaultErrorMessage = "Что-то пошло не так, попробуйте еще раз."
+
+// max number of stages kept in the session history
+const maxHistory = 32
 
 type agentRunner struct{
 	agent Agent
-	sessions map[string]session
-	channel chan Update
 }
 
 type Manager struct {
 	runners    []agentRunner
 	entryPoint func() Handler
+	store      SessionStore
+	workers    int
+	errorText  string
+	middleware []Middleware
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
 }
 
 type Ctx interface {
 	Close()
+	// transition to next stage, current one is pushed to the history
 	SetNext(next Handler)
+	// transition to next stage that can go back with Return
+	Call(next Handler)
+	// transition to previous stage from the history, false if history is empty
+	Back() bool
+	// transition to the stage that called current one, false if there is none
+	Return() bool
+	// transition to next stage forgetting the history
+	Reset(next Handler)
 	Next() (Handler, bool)
 	Transitioning() bool
 	Closed() bool
@@ -65,42 +119,79 @@ type Ctx interface {
 	Finalized() bool
 	GetKey(key string) (interface{}, bool)
 	SetKey(key string, value interface{})
+	// forgets all the keys, e.g. answers that were submitted
+	ClearKeys()
 }
 
 type ctx struct {
 	update  Update
 	next    Handler
 	closed  bool
-	storage *keystorage
+	session *Session
+	// history of the session after transition
+	history []HistoryEntry
 }
 
-func newContext(update Update, ks *keystorage) Ctx {
+func newContext(update Update, session *Session) *ctx {
 	return &ctx{
 		update:  update,
 		closed:  false,
-		storage: ks,
+		session: session,
 	}
 }
 
 func (ctx *ctx) Close()               { ctx.closed = true }
-func (ctx *ctx) SetNext(next Handler) { ctx.next = next }
+func (ctx *ctx) SetNext(next Handler) { ctx.push(next, false) }
+func (ctx *ctx) Call(next Handler)    { ctx.push(next, true) }
+func (ctx *ctx) push(next Handler, call bool) {
+	history := ctx.session.History
+	if len(history) >= maxHistory {
+		history = history[len(history)-maxHistory+1:]
+	}
+	ctx.next = next
+	ctx.history = append(append([]HistoryEntry(nil), history...), HistoryEntry{Stage: ctx.session.Handler, Call: call})
+}
+func (ctx *ctx) Back() bool {
+	history := ctx.session.History
+	if len(history) == 0 {
+		return false
+	}
+	ctx.next = history[len(history)-1].Stage
+	ctx.history = history[:len(history)-1]
+	return true
+}
+func (ctx *ctx) Return() bool {
+	history := ctx.session.History
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Call {
+			ctx.next = history[i].Stage
+			ctx.history = history[:i]
+			return true
+		}
+	}
+	return false
+}
+func (ctx *ctx) Reset(next Handler) {
+	ctx.next = next
+	ctx.history = nil
+}
 func (ctx *ctx) Next() (Handler, bool) {
 	return ctx.next, ctx.Transitioning() && !ctx.Closed()
 }
 func (ctx *ctx) Closed() bool        { return ctx.closed }
 func (ctx *ctx) Update() Update      { return ctx.update }
 func (ctx *ctx) Finalized() bool     { return false }
-func (ctx *ctx) Transitioning() bool { return ctx.next != nil }
+func (ctx *ctx) Transitioning() bool { return ctx.next != nil || ctx.closed }
 func (ctx *ctx) GetKey(key string) (interface{}, bool) {
-	value, found := (*ctx.storage)[key]
+	value, found := ctx.session.KeyStorage[key]
 	return value, found
 }
-func (ctx *ctx) SetKey(key string, value interface{}) { (*ctx.storage)[key] = value }
+func (ctx *ctx) SetKey(key string, value interface{}) { ctx.session.KeyStorage[key] = value }
+func (ctx *ctx) ClearKeys()                            { ctx.session.KeyStorage = make(keystorage) }
 
 func newAgentRunner(agent Agent) agentRunner{
 	return agentRunner{
 		agent: agent,
-		sessions: make(map[string]session),
 	};
 }
 
@@ -108,87 +199,163 @@ func NewManager(entryPoint func() Handler) *Manager {
 	return &Manager{
 		runners:    make([]agentRunner,0),
 		entryPoint: entryPoint,
+		store:      NewMemoryStore(),
+		workers:    DefaultWorkers,
+		errorText:  DefaultErrorMessage,
 	}
 }
 
+// replaces the default in-memory session store, call before Run
+func (m *Manager) SetSessionStore(store SessionStore) {
+	m.store = store
+}
+
+// adds middleware around update handling, first added is the outermost
+func (m *Manager) Use(middleware ...Middleware) {
+	m.middleware = append(m.middleware, middleware...)
+}
+
+func (m *Manager) chain(handler UpdateHandler) UpdateHandler {
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		handler = m.middleware[i](handler)
+	}
+	return handler
+}
+
+// message sent to the user when handling of their update fails
+func (m *Manager) SetErrorMessage(text string) {
+	m.errorText = text
+}
+
+// number of chats handled in parallel, call before Run
+func (m *Manager) SetWorkers(n int) {
+	m.workers = n
+}
+
 
 func (m *Manager) AddAgent(agent Agent){
 	m.runners = append(m.runners, newAgentRunner(agent))
 }
 
-func (m *Manager) Run() error {
+// runs agents until ctx is done or Stop is called
+// returns after agents stopped and all received updates were handled
+func (m *Manager) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
 	if len(m.runners) == 0 {
 		return fmt.Errorf("Trying to start with no registered agents");
 	}
-	defer m.Stop();
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+
+	pool := newWorkerPool(m.workers, m.process)
+	var err error
 	for _, runner := range m.runners{
-		ec := runner.Run(m.entryPoint, &wg);
-		if ec != nil {
-			return ec;
+		if err = runner.Run(ctx, pool, &wg); err != nil {
+			// stop already started agents
+			cancel()
+			break
 		}
 	}
 
-	// wait for all runners to stop
+	// wait for all runners to stop and for the queued updates to be handled
 	wg.Wait()
-	return nil
+	pool.Stop()
+	return err
 }
 
 func (m *Manager) Stop() {
-	for _, runner := range m.runners{
-		runner.Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
 	}
 }
 
-func (m *agentRunner) handle(handle *Handler, ctx Ctx) error {
-	(*handle).Handle(ctx)
-	if next, v := ctx.Next(); v {
-		(*handle) = next
-		(*handle).Welcome(ctx)
+// handle runs handler with ctx which might be wrapped by middleware, c is the original one
+func (m *Manager) handle(sess *Session, c *ctx, ctx Ctx) error {
+	if err := sess.Handler.Handle(ctx); err != nil {
+		return err
 	}
-	if closed := ctx.Closed(); closed {
-		(*handle) = nil
+	if next, v := c.Next(); v {
+		sess.Handler = next
+		sess.History = c.history
+		if err := sess.Handler.Welcome(ctx); err != nil {
+			return err
+		}
+	}
+	if closed := c.Closed(); closed {
+		sess.Handler = nil
+		sess.History = nil
 	}
 	return nil
 }
 
-func (m *agentRunner) Run(entryPoint func() Handler, wg *sync.WaitGroup) error {
-	wg.Add(1)
-	ch, err := m.agent.Run()
+// handles single update within its chat session, updates of one chat come in order
+// if handling fails the user is notified and the session goes back to the stage it was on
+func (m *Manager) process(update Update) {
+	if completer, ok := update.(Completer); ok {
+		defer completer.Complete()
+	}
+	chatID := update.ChatID()
+	sess, err := m.store.Load(chatID)
 	if err != nil {
-		return err
+		log.Printf("chat %s: cant load session, starting over: %v", chatID, err)
+	}
+	if sess == nil {
+		sess = newSession()
 	}
-	m.channel = ch
-	go func() {
-		for update := range m.channel {
-			var sess session = session{}
-			var found bool
-			chatID := update.ChatID()
-			if sess, found = m.sessions[chatID]; !found {
-				m.sessions[chatID] = sess
-			}
-			if sess.KeyStorage == nil {
-				sess.KeyStorage = make(keystorage)
-			}
 
-			ctx := newContext(update, &sess.KeyStorage)
-			if sess.Handler == nil {
-				sess.Handler = entryPoint()
-				sess.Handler.Welcome(ctx)
-			}
-			if err = m.handle(&sess.Handler, ctx); err != nil {
-				// todo: log errors
-				log.Println(err)
+	c := newContext(update, sess)
+	stage, history := sess.Handler, sess.History
+	// middleware can stop the update before it gets to the session
+	reached := false
+	handle := m.chain(func(ctx Ctx) error {
+		reached = true
+		if sess.Handler == nil {
+			sess.Handler = m.entryPoint()
+			if err := sess.Handler.Welcome(ctx); err != nil {
+				return err
 			}
-			m.sessions[chatID] = sess
+		}
+		return m.handle(sess, c, ctx)
+	})
+	if err = handle(c); err != nil {
+		log.Printf("chat %s: failed to handle update: %v", chatID, err)
+		sess.Handler, sess.History = stage, history
+		if err = update.Reply(m.errorText); err != nil {
+			log.Printf("chat %s: cant send error message: %v", chatID, err)
+		}
+	}
+	if !reached {
+		return
+	}
+	// closed conversation with nothing left is not kept, the next update starts over anyway
+	if sess.Handler == nil && len(sess.KeyStorage) == 0 {
+		if err = m.store.Delete(chatID); err != nil {
+			log.Printf("chat %s: cant delete session: %v", chatID, err)
+		}
+		return
+	}
+	if err = m.store.Save(chatID, sess); err != nil {
+		log.Printf("chat %s: cant save session: %v", chatID, err)
+	}
+}
+
+func (m *agentRunner) Run(ctx context.Context, pool *workerPool, wg *sync.WaitGroup) error {
+	ch, err := m.agent.Run(ctx)
+	if err != nil {
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		for update := range ch {
+			pool.Dispatch(update)
 		}
 		wg.Done()
 	}()
 
 	return nil
 }
-
-func (r *agentRunner) Stop() {
-	close(r.channel)
-}
-
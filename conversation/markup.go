@@ -0,0 +1,153 @@
+package conversation
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// texts sent with Update.Reply are markup, agents render it for their platform:
+// **bold**, __italic__, [label](url) and lines starting with "- " as list items
+// backslash makes the next character plain, user input has to go through EscapeMarkup
+
+const bullet = "• "
+
+// piece of text with the same formatting
+type Span struct {
+	Text   string
+	Bold   bool
+	Italic bool
+	// link of the span, plain text if empty
+	URL string
+}
+
+type Markup []Span
+
+func ParseMarkup(s string) Markup {
+	p := markupParser{src: s}
+	p.parse()
+	return p.spans
+}
+
+// escapes everything that would be read as formatting
+func EscapeMarkup(s string) string {
+	var b strings.Builder
+	lineStart := true
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '*' || r == '_' || r == '[':
+			b.WriteRune('\\')
+		case r == '-' && lineStart:
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+		lineStart = r == '\n' || (lineStart && r == ' ')
+	}
+	return b.String()
+}
+
+// text without formatting, links are followed by their url
+func (m Markup) Plain() string {
+	var b strings.Builder
+	for _, span := range m {
+		b.WriteString(span.Text)
+		if span.URL != "" && span.URL != span.Text {
+			b.WriteString(" (" + span.URL + ")")
+		}
+	}
+	return b.String()
+}
+
+// html with b, i and a tags, as accepted by tg parse_mode HTML
+func (m Markup) HTML() string {
+	var b strings.Builder
+	for _, span := range m {
+		text := html.EscapeString(span.Text)
+		if span.Italic {
+			text = "<i>" + text + "</i>"
+		}
+		if span.Bold {
+			text = "<b>" + text + "</b>"
+		}
+		if span.URL != "" {
+			text = `<a href="` + html.EscapeString(span.URL) + `">` + text + "</a>"
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+type markupParser struct {
+	src    string
+	pos    int
+	bold   bool
+	italic bool
+	text   strings.Builder
+	spans  Markup
+}
+
+func (p *markupParser) flush() {
+	if p.text.Len() == 0 {
+		return
+	}
+	p.spans = append(p.spans, Span{Text: p.text.String(), Bold: p.bold, Italic: p.italic})
+	p.text.Reset()
+}
+
+func (p *markupParser) parse() {
+	lineStart := true
+	for p.pos < len(p.src) {
+		rest := p.src[p.pos:]
+		if lineStart {
+			indent := len(rest) - len(strings.TrimLeft(rest, " "))
+			if strings.HasPrefix(rest[indent:], "- ") {
+				p.text.WriteString(rest[:indent] + bullet)
+				p.pos += indent + len("- ")
+				lineStart = false
+				continue
+			}
+		}
+		lineStart = rest[0] == '\n'
+		switch {
+		case rest[0] == '\\' && len(rest) > 1:
+			p.pos++
+			p.literal()
+		case strings.HasPrefix(rest, "**") && (p.bold || strings.Contains(rest[2:], "**")):
+			p.flush()
+			p.bold = !p.bold
+			p.pos += 2
+		case strings.HasPrefix(rest, "__") && (p.italic || strings.Contains(rest[2:], "__")):
+			p.flush()
+			p.italic = !p.italic
+			p.pos += 2
+		case rest[0] == '[' && p.link():
+		default:
+			p.literal()
+		}
+	}
+	p.flush()
+}
+
+// copies the character at pos as is
+func (p *markupParser) literal() {
+	_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.text.WriteString(p.src[p.pos : p.pos+size])
+	p.pos += size
+}
+
+// [label](url) at pos, false if it is not a link
+func (p *markupParser) link() bool {
+	rest := p.src[p.pos:]
+	label, after, found := strings.Cut(rest[1:], "](")
+	if !found || label == "" || strings.ContainsAny(label, "[]\n") {
+		return false
+	}
+	url, _, found := strings.Cut(after, ")")
+	if !found || url == "" || strings.ContainsAny(url, " \n") {
+		return false
+	}
+	p.flush()
+	p.spans = append(p.spans, Span{Text: label, Bold: p.bold, Italic: p.italic, URL: url})
+	p.pos += len("[") + len(label) + len("](") + len(url) + len(")")
+	return true
+}
@@ -0,0 +1,41 @@
+package conversation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkup(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Markup
+	}{
+		{"plain text", Markup{{Text: "plain text"}}},
+		{"**bold** and __italic__", Markup{{Text: "bold", Bold: true}, {Text: " and "}, {Text: "italic", Italic: true}}},
+		{"write to [@karevaina](https://t.me/karevaina)", Markup{{Text: "write to "}, {Text: "@karevaina", URL: "https://t.me/karevaina"}}},
+		{"list:\n- one\n  - two", Markup{{Text: "list:\n• one\n  • two"}}},
+		{"2 ** 3, user_name, [x] and a-b", Markup{{Text: "2 ** 3, user_name, [x] and a-b"}}},
+		{`\*\*not bold\*\*`, Markup{{Text: "**not bold**"}}},
+	}
+	for _, tt := range tests {
+		if got := ParseMarkup(tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMarkup(%q) = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeMarkup(t *testing.T) {
+	for _, s := range []string{"**a** __b__ [c](d)", "- item\n  - item", `back\slash`, "обычный текст"} {
+		if got := ParseMarkup(EscapeMarkup(s)).Plain(); got != s {
+			t.Errorf("escaped %q is read as %q", s, got)
+		}
+	}
+}
+
+func TestMarkupHTML(t *testing.T) {
+	got := ParseMarkup("**<b>** & [link](https://example.org/?a=1&b=2)").HTML()
+	want := `<b>&lt;b&gt;</b> &amp; <a href="https://example.org/?a=1&amp;b=2">link</a>`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package conversation
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// handles update within its session, manager wraps it with registered middleware
+type UpdateHandler = func(ctx Ctx) error
+
+// middleware may inspect the update, skip next to drop it
+// or pass ctx from WithUpdate to decorate replies
+type Middleware = func(next UpdateHandler) UpdateHandler
+
+type updateCtx struct {
+	Ctx
+	update Update
+}
+
+func (ctx *updateCtx) Update() Update { return ctx.update }
+
+// returns ctx that exposes update instead of the original one
+func WithUpdate(ctx Ctx, update Update) Ctx {
+	return &updateCtx{Ctx: ctx, update: update}
+}
+
+// logs every update with time it took to handle it
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	return func(next UpdateHandler) UpdateHandler {
+		return func(ctx Ctx) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				logger.Printf("chat %s: handled in %v with error: %v", ctx.Update().ChatID(), time.Since(start), err)
+			} else {
+				logger.Printf("chat %s: handled in %v", ctx.Update().ChatID(), time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// drops updates from the listed chats, ids are the ones returned by Update.ChatID
+func BlocklistMiddleware(chatIDs ...string) Middleware {
+	blocked := make(map[string]bool, len(chatIDs))
+	for _, id := range chatIDs {
+		blocked[id] = true
+	}
+	return func(next UpdateHandler) UpdateHandler {
+		return func(ctx Ctx) error {
+			if blocked[ctx.Update().ChatID()] {
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// which chats the bot talks in
+type ChatPolicy string
+
+const (
+	// group messages addressed to the bot are answered with the redirect message
+	PrivateChatsOnly ChatPolicy = "private"
+	// group messages addressed to the bot are handled, the rest of the group chatter is ignored
+	GroupChats ChatPolicy = "group"
+)
+
+// filters updates from group chats according to policy, see GroupUpdate
+// private chats and updates of platforms without groups always pass
+func ChatPolicyMiddleware(policy ChatPolicy, redirect string) Middleware {
+	return func(next UpdateHandler) UpdateHandler {
+		return func(ctx Ctx) error {
+			group, ok := ctx.Update().(GroupUpdate)
+			if !ok || !group.InGroup() {
+				return next(ctx)
+			}
+			if !group.Addressed() {
+				return nil
+			}
+			if policy == GroupChats {
+				return next(ctx)
+			}
+			if redirect != "" {
+				return ctx.Update().Reply(redirect)
+			}
+			return nil
+		}
+	}
+}
+
+// allows at most limit updates per chat within period, the rest are dropped
+// message is sent once when chat goes over the limit
+func FloodControlMiddleware(limit int, period time.Duration, message string) Middleware {
+	type window struct {
+		start    time.Time
+		count    int
+		notified bool
+	}
+	var mu sync.Mutex
+	windows := make(map[string]*window)
+	return func(next UpdateHandler) UpdateHandler {
+		return func(ctx Ctx) error {
+			chatID := ctx.Update().ChatID()
+			now := time.Now()
+			mu.Lock()
+			// forget chats that were quiet for a while
+			for id, w := range windows {
+				if now.Sub(w.start) > period {
+					delete(windows, id)
+				}
+			}
+			w, found := windows[chatID]
+			if !found {
+				w = &window{start: now}
+				windows[chatID] = w
+			}
+			w.count++
+			allowed, notify := w.count <= limit, false
+			if !allowed && !w.notified {
+				w.notified, notify = true, true
+			}
+			mu.Unlock()
+
+			if allowed {
+				return next(ctx)
+			}
+			if notify && message != "" {
+				return ctx.Update().Reply(message)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package conversation_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+	"github.com/spanditime/go-survey-bot/conversation/conversationtest"
+)
+
+type groupUpdate struct {
+	*conversationtest.Update
+	group     bool
+	addressed bool
+}
+
+func (upd groupUpdate) InGroup() bool   { return upd.group }
+func (upd groupUpdate) Addressed() bool { return upd.addressed }
+
+func TestChatPolicyMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    conversation.ChatPolicy
+		group     bool
+		addressed bool
+		handled   bool
+		replies   int
+	}{
+		{name: "private chat", policy: conversation.PrivateChatsOnly, handled: true},
+		{name: "group chatter", policy: conversation.PrivateChatsOnly, group: true},
+		{name: "redirect to private chat", policy: conversation.PrivateChatsOnly, group: true, addressed: true, replies: 1},
+		{name: "group chatter in group mode", policy: conversation.GroupChats, group: true},
+		{name: "mention in group mode", policy: conversation.GroupChats, group: true, addressed: true, handled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			handler := conversation.ChatPolicyMiddleware(tt.policy, "Write me in private")(func(ctx conversation.Ctx) error {
+				handled = true
+				return nil
+			})
+			update := groupUpdate{conversationtest.NewUpdate("chat", "hi", conversationtest.DefaultSender), tt.group, tt.addressed}
+			if err := handler(conversation.WithUpdate(nil, update)); err != nil {
+				t.Fatal(err)
+			}
+			if handled != tt.handled || len(update.Replies()) != tt.replies {
+				t.Errorf("handled %v with %d replies, want %v with %d", handled, len(update.Replies()), tt.handled, tt.replies)
+			}
+		})
+	}
+}
+
+// memory store counting saves by chat
+type countingStore struct {
+	*conversation.MemoryStore
+	mu    sync.Mutex
+	saves map[string]int
+}
+
+func (s *countingStore) Save(chatID string, sess *conversation.Session) error {
+	s.mu.Lock()
+	s.saves[chatID]++
+	s.mu.Unlock()
+	return s.MemoryStore.Save(chatID, sess)
+}
+
+func TestStoppedUpdatesDontSaveSessions(t *testing.T) {
+	store := &countingStore{MemoryStore: conversation.NewMemoryStore(), saves: make(map[string]int)}
+	manager := conversation.NewManager(func() conversation.Handler {
+		return conversation.NewAnswerHandler(conversation.EmptyAction(), "Name?", conversation.EmptyAction())
+	})
+	manager.SetSessionStore(store)
+	manager.Use(func(next conversation.UpdateHandler) conversation.UpdateHandler {
+		return func(ctx conversation.Ctx) error {
+			if ctx.Update().GetMessage() == "spam" {
+				return nil
+			}
+			return next(ctx)
+		}
+	})
+	agent := conversationtest.Start(t, manager)
+	for _, chat := range []string{"chat", "spammer"} {
+		if _, err := agent.Send(chat, "spam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := agent.Send("chat", "Ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.saves["chat"] != 1 || store.saves["spammer"] != 0 {
+		t.Errorf("got saves %v, want only the handled update saved", store.saves)
+	}
+	if sess, _ := store.Load("spammer"); sess != nil {
+		t.Errorf("session of ignored chat is stored")
+	}
+}
@@ -0,0 +1,184 @@
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// returned by Outbox.Send when the message couldnt be delivered within the limits
+var ErrMessageDropped = errors.New("message dropped")
+
+// outbound limits of a platform, zero rate means no limit
+type RateLimit struct {
+	// messages per second across all chats
+	Global      float64
+	GlobalBurst int
+	// messages per second within one chat
+	Chat      float64
+	ChatBurst int
+}
+
+type OutboxConfig struct {
+	RateLimit
+	// attempts before the message is dropped
+	MaxAttempts int
+	// first delay of the exponential backoff, used when the platform doesnt say how long to wait
+	Backoff time.Duration
+	// message is dropped instead of waiting longer than that for its turn
+	MaxDelay time.Duration
+	// whether failed send is worth retrying and after what delay, 0 means backoff
+	Retry func(err error) (after time.Duration, retry bool)
+}
+
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultMaxDelay    = 30 * time.Second
+)
+
+// outbound queue of an agent, messages wait for their turn within the rate limits
+// and are retried when the platform asks to slow down
+type Outbox struct {
+	config OutboxConfig
+
+	mu     sync.Mutex
+	global bucket
+	chats  map[string]*bucket
+	// nothing is sent until then, set by retry after of the platform
+	paused time.Time
+}
+
+func NewOutbox(config OutboxConfig) *Outbox {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = DefaultBackoff
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultMaxDelay
+	}
+	return &Outbox{
+		config: config,
+		global: newBucket(config.Global, config.GlobalBurst),
+		chats:  make(map[string]*bucket),
+	}
+}
+
+// calls send once the limits allow it, blocks until the message is sent or dropped
+// dropped messages are reported with ErrMessageDropped wrapping the last error
+func (o *Outbox) Send(chatID string, send func() error) error {
+	var err error
+	for attempt := 0; attempt < o.config.MaxAttempts; attempt++ {
+		at, ok := o.reserve(chatID)
+		if !ok {
+			return o.dropped(chatID, attempt, fmt.Errorf("no turn within %v", o.config.MaxDelay))
+		}
+		time.Sleep(time.Until(at))
+
+		if err = send(); err == nil {
+			return nil
+		}
+		after, retry := time.Duration(0), false
+		if o.config.Retry != nil {
+			after, retry = o.config.Retry(err)
+		}
+		if !retry {
+			return err
+		}
+		if after <= 0 {
+			after = o.config.Backoff << attempt
+		}
+		if after > o.config.MaxDelay {
+			return o.dropped(chatID, attempt+1, err)
+		}
+		o.pause(after)
+	}
+	return o.dropped(chatID, o.config.MaxAttempts, err)
+}
+
+func (o *Outbox) dropped(chatID string, attempts int, err error) error {
+	return fmt.Errorf("%w: chat %s after %d attempts: %w", ErrMessageDropped, chatID, attempts, err)
+}
+
+// time the message can be sent at, false if it is too far away
+func (o *Outbox) reserve(chatID string) (time.Time, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	// forget chats that caught up with their limit
+	for id, b := range o.chats {
+		if !b.busy(now) {
+			delete(o.chats, id)
+		}
+	}
+	chat, found := o.chats[chatID]
+	if !found {
+		b := newBucket(o.config.Chat, o.config.ChatBurst)
+		chat = &b
+	}
+	at := now
+	for _, t := range []time.Time{o.paused, o.global.next(now), chat.next(now)} {
+		if t.After(at) {
+			at = t
+		}
+	}
+	if at.Sub(now) > o.config.MaxDelay {
+		return time.Time{}, false
+	}
+	// the message goes out at at, not now, the buckets have to count it from then
+	o.global.take(at)
+	chat.take(at)
+	o.chats[chatID] = chat
+	return at, true
+}
+
+func (o *Outbox) pause(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if until := time.Now().Add(d); until.After(o.paused) {
+		o.paused = until
+	}
+}
+
+// generic cell rate algorithm: tat is the time the bucket would be empty
+type bucket struct {
+	interval time.Duration
+	burst    int
+	tat      time.Time
+}
+
+func newBucket(rate float64, burst int) bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := bucket{burst: burst}
+	if rate > 0 {
+		b.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return b
+}
+
+// earliest time the next message fits
+func (b *bucket) next(now time.Time) time.Time {
+	if b.interval == 0 || b.tat.Before(now) {
+		return now
+	}
+	return b.tat.Add(-time.Duration(b.burst-1) * b.interval)
+}
+
+func (b *bucket) take(now time.Time) {
+	if b.interval == 0 {
+		return
+	}
+	if b.tat.Before(now) {
+		b.tat = now
+	}
+	b.tat = b.tat.Add(b.interval)
+}
+
+func (b *bucket) busy(now time.Time) bool {
+	return b.tat.After(now)
+}
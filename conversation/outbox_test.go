@@ -0,0 +1,115 @@
+package conversation
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFlood = errors.New("too many requests")
+
+func retryFlood(err error) (time.Duration, bool) {
+	return 10 * time.Millisecond, errors.Is(err, errFlood)
+}
+
+func TestOutboxChatRateLimit(t *testing.T) {
+	outbox := NewOutbox(OutboxConfig{RateLimit: RateLimit{Chat: 50, ChatBurst: 1}})
+	send := func() error { return nil }
+
+	start := time.Now()
+	for range 3 {
+		if err := outbox.Send("first", send); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 messages to one chat sent in %v, want at least 40ms", elapsed)
+	}
+
+	start = time.Now()
+	if err := outbox.Send("second", send); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("message to another chat waited %v", elapsed)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	outbox := NewOutbox(OutboxConfig{MaxAttempts: 3, Retry: retryFlood})
+
+	attempts := 0
+	err := outbox.Send("chat", func() error {
+		attempts++
+		if attempts == 1 {
+			return errFlood
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("got %v after %d attempts, want success after 2", err, attempts)
+	}
+
+	attempts = 0
+	err = outbox.Send("chat", func() error {
+		attempts++
+		return errFlood
+	})
+	if !errors.Is(err, ErrMessageDropped) || !errors.Is(err, errFlood) || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want dropped after 3", err, attempts)
+	}
+
+	other := errors.New("chat not found")
+	attempts = 0
+	err = outbox.Send("chat", func() error {
+		attempts++
+		return other
+	})
+	if err != other || attempts != 1 {
+		t.Errorf("got %v after %d attempts, want the error right away", err, attempts)
+	}
+}
+
+func TestOutboxDropsWhenRetryIsTooFar(t *testing.T) {
+	outbox := NewOutbox(OutboxConfig{MaxDelay: time.Second, Retry: func(error) (time.Duration, bool) {
+		return time.Minute, true
+	}})
+	err := outbox.Send("chat", func() error { return errFlood })
+	if !errors.Is(err, ErrMessageDropped) {
+		t.Errorf("got %v, want dropped", err)
+	}
+}
+
+func TestOutboxSpreadsMessagesAfterPause(t *testing.T) {
+	outbox := NewOutbox(OutboxConfig{RateLimit: RateLimit{Global: 20, GlobalBurst: 1}})
+	outbox.pause(100 * time.Millisecond)
+
+	var mu sync.Mutex
+	var sent []time.Time
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := outbox.Send("chat", func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				sent = append(sent, time.Now())
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(sent, func(i, j int) bool { return sent[i].Before(sent[j]) })
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("messages %d and %d sent %v apart, want about 50ms", i-1, i, gap)
+		}
+	}
+}
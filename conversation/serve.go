@@ -0,0 +1,60 @@
+package conversation
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// requests in flight get that long to finish when the server stops
+const ShutdownTimeout = 10 * time.Second
+
+// http server of an agent, serves https if certFile is set and plain http otherwise
+// (when tls is terminated by a reverse proxy)
+// address and certificate errors are returned right away, the returned channel is closed
+// once ctx is done and the requests in flight are finished
+func Serve(ctx context.Context, name, addr, certFile, keyFile string, handler http.Handler) (<-chan struct{}, error) {
+	server := &http.Server{Handler: handler}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cant load certificate of %s server: %w", name, err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cant start %s server: %w", name, err)
+	}
+
+	go func() {
+		var err error
+		log.Printf("%s server listening on %s", name, listener.Addr())
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s server stopped with error: %v", name, err)
+		}
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		log.Printf("stopping %s server", name)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("%s server shutdown: %v", name, err)
+			server.Close()
+		}
+		close(stopped)
+	}()
+	return stopped, nil
+}
@@ -0,0 +1,28 @@
+package conversation
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeReportsBusyAddress(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := Serve(ctx, "test", busy.Addr().String(), "", "", http.NotFoundHandler()); err == nil {
+		t.Error("server started on a busy address")
+	}
+	stopped, err := Serve(ctx, "test", "127.0.0.1:0", "", "", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,77 @@
+package conversation
+
+import "strings"
+
+const (
+	// tg and vk dont accept longer messages
+	MaxMessageLength = 4096
+	// longer answers are cut by ShortAnswer
+	ShortAnswerLength = 100
+)
+
+// splits text longer than limit into parts that fit, on paragraphs if possible,
+// then on lines and words, agents send the parts one by one with the keyboard on the last one
+// length is counted in utf-16 code units as tg does
+func SplitText(text string, limit int) []string {
+	if limit <= 0 || textLength(text) <= limit {
+		return []string{text}
+	}
+	parts := []string{}
+	for textLength(text) > limit {
+		cut := cutIndex(text, limit)
+		if part := strings.TrimRight(text[:cut], " \n"); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeft(text[cut:], " \n")
+	}
+	if text = strings.TrimRight(text, " \n"); text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+func textLength(text string) int {
+	n := 0
+	for _, r := range text {
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+	}
+	return n
+}
+
+// end of the longest prefix that fits in limit and ends at a paragraph, line or word
+func cutIndex(text string, limit int) int {
+	end, n := 0, 0
+	for i, r := range text {
+		size := 1
+		if r > 0xFFFF {
+			size = 2
+		}
+		if n+size > limit {
+			break
+		}
+		n += size
+		end = i + len(string(r))
+	}
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(text[:end], sep); i > 0 {
+			return i
+		}
+	}
+	return end
+}
+
+// first line of the answer, not longer than ShortAnswerLength runes, e.g. for the compact review
+func ShortAnswer(answer string) string {
+	line, _, multiline := strings.Cut(answer, "\n")
+	runes := []rune(line)
+	if len(runes) > ShortAnswerLength {
+		return string(runes[:ShortAnswerLength]) + "…"
+	}
+	if multiline {
+		return line + "…"
+	}
+	return line
+}
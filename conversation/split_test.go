@@ -0,0 +1,47 @@
+package conversation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"paragraphs", "first one\n\nsecond\nline", 16, []string{"first one", "second\nline"}},
+		{"lines", "first line\nsecond line", 16, []string{"first line", "second line"}},
+		{"words", "one two three four", 9, []string{"one two", "three", "four"}},
+		{"no breaks", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"emoji count twice", "📎📎📎", 4, []string{"📎📎", "📎"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitText(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTextFitsLimit(t *testing.T) {
+	text := strings.Repeat("Как мы можем к Вам обращаться?\nИван\n\n", 300)
+	parts := SplitText(text, MaxMessageLength)
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts", len(parts))
+	}
+	for _, part := range parts {
+		if n := textLength(part); n > MaxMessageLength {
+			t.Errorf("part of %d characters", n)
+		}
+	}
+	if strings.Join(parts, "\n\n") != strings.TrimSpace(text) {
+		t.Errorf("text is not split on paragraphs")
+	}
+}
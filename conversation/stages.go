@@ -0,0 +1,116 @@
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// named stages, a session refers to its stage by name and params
+// so it can be stored and rebuilt after a restart
+type StageParams map[string]string
+
+type StageBuilder = func(params StageParams, ctx Ctx) Handler
+
+type StageRegistry struct {
+	builders map[string]StageBuilder
+}
+
+func NewStageRegistry() *StageRegistry {
+	return &StageRegistry{
+		builders: make(map[string]StageBuilder),
+	}
+}
+
+func (r *StageRegistry) Register(name string, builder StageBuilder) {
+	if _, found := r.builders[name]; found {
+		panic(fmt.Sprintf("stage %q is already registered", name))
+	}
+	r.builders[name] = builder
+}
+
+// returns handler of the named stage, the actual handler is built on every use
+// so it always reflects current keys of the session
+func (r *StageRegistry) Stage(name string, params StageParams) Handler {
+	return &StageRef{
+		Name:     name,
+		Params:   params,
+		registry: r,
+	}
+}
+
+func (r *StageRegistry) EntryPoint(name string) func() Handler {
+	return func() Handler { return r.Stage(name, nil) }
+}
+
+func (r *StageRegistry) TransitionAction(name string, params StageParams) Action {
+	return func(answer string, ctx Ctx) error {
+		ctx.SetNext(r.Stage(name, params))
+		return nil
+	}
+}
+
+// transition that can be returned from with Ctx.Return
+func (r *StageRegistry) CallAction(name string, params StageParams) Action {
+	return func(answer string, ctx Ctx) error {
+		ctx.Call(r.Stage(name, params))
+		return nil
+	}
+}
+
+// transition that forgets the history
+func (r *StageRegistry) ResetAction(name string, params StageParams) Action {
+	return func(answer string, ctx Ctx) error {
+		ctx.Reset(r.Stage(name, params))
+		return nil
+	}
+}
+
+func (r *StageRegistry) EncodeStage(handler Handler) ([]byte, error) {
+	ref, ok := handler.(*StageRef)
+	if !ok {
+		return nil, fmt.Errorf("handler %T is not a registered stage", handler)
+	}
+	return json.Marshal(ref)
+}
+
+func (r *StageRegistry) DecodeStage(data []byte) (Handler, error) {
+	ref := &StageRef{registry: r}
+	if err := json.Unmarshal(data, ref); err != nil {
+		return nil, err
+	}
+	if _, found := r.builders[ref.Name]; !found {
+		return nil, fmt.Errorf("unknown stage %q", ref.Name)
+	}
+	return ref, nil
+}
+
+type StageRef struct {
+	Name   string      `json:"name"`
+	Params StageParams `json:"params,omitempty"`
+
+	registry *StageRegistry
+}
+
+func (ref *StageRef) resolve(ctx Ctx) (Handler, error) {
+	builder, found := ref.registry.builders[ref.Name]
+	if !found {
+		return nil, fmt.Errorf("unknown stage %q", ref.Name)
+	}
+	return builder(ref.Params, ctx), nil
+}
+
+func (ref *StageRef) Handle(ctx Ctx) error {
+	handler, err := ref.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Handle(ctx)
+}
+
+func (ref *StageRef) Welcome(ctx Ctx) error {
+	handler, err := ref.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Welcome(ctx)
+}
@@ -0,0 +1,64 @@
+package conversation
+
+import (
+	"sync"
+)
+
+// Session is the state of a single chat: current stage, visited stages and collected keys
+type Session struct {
+	Handler    Handler
+	History    []HistoryEntry
+	KeyStorage keystorage
+}
+
+// visited stage, Call marks stages that can be returned to with Ctx.Return
+type HistoryEntry struct {
+	Stage Handler
+	Call  bool
+}
+
+func newSession() *Session {
+	return &Session{
+		KeyStorage: make(keystorage),
+	}
+}
+
+// SessionStore keeps sessions between updates
+// Load returns nil session and no error if chat has no session yet
+type SessionStore interface {
+	Load(chatID string) (*Session, error)
+	Save(chatID string, sess *Session) error
+	Delete(chatID string) error
+}
+
+// in-memory store, sessions are lost on restart
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *MemoryStore) Load(chatID string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[chatID], nil
+}
+
+func (s *MemoryStore) Save(chatID string, sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[chatID] = sess
+	return nil
+}
+
+func (s *MemoryStore) Delete(chatID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, chatID)
+	return nil
+}
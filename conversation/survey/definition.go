@@ -0,0 +1,303 @@
+package survey
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+	"gopkg.in/yaml.v3"
+)
+
+// declarative description of a survey, see survey.yaml in the repo root for an example
+// texts are markup, see conversation.ParseMarkup
+type Definition struct {
+	Start   Start   `yaml:"start" json:"start"`
+	Welcome Welcome `yaml:"welcome" json:"welcome"`
+	Cancel  string  `yaml:"cancel" json:"cancel"`
+	// label of the button that goes to the previous question, no such button if empty
+	Back      string     `yaml:"back" json:"back"`
+	Questions []Question `yaml:"questions" json:"questions"`
+	Review    Review     `yaml:"review" json:"review"`
+	// name of the sink the answers are submitted to
+	Sink string `yaml:"sink" json:"sink"`
+	// sent when something goes wrong, conversation.DefaultErrorMessage if empty
+	ErrorMessage string `yaml:"error_message" json:"error_message"`
+	// sent when a file is sent to a question without attachments, conversation.DefaultAttachmentMessage if empty
+	AttachmentMessage string `yaml:"attachment_message" json:"attachment_message"`
+	// keyboard layout of all stages unless stage sets its own
+	Layout *Layout `yaml:"layout" json:"layout"`
+}
+
+// how options are placed on the keyboard, see conversation.Layout
+type Layout struct {
+	Rows       []int `yaml:"rows" json:"rows"`
+	OneTime    bool  `yaml:"one_time" json:"one_time"`
+	Persistent bool  `yaml:"persistent" json:"persistent"`
+	// buttons under the message, tg sends pressed option as a callback query
+	Inline bool `yaml:"inline" json:"inline"`
+}
+
+func (l *Layout) or(fallback *Layout) *Layout {
+	if l == nil {
+		return fallback
+	}
+	return l
+}
+
+func (l *Layout) layout() conversation.Layout {
+	if l == nil {
+		return conversation.Layout{}
+	}
+	return conversation.Layout{
+		Rows:       l.Rows,
+		OneTime:    l.OneTime,
+		Persistent: l.Persistent,
+		Inline:     l.Inline,
+	}
+}
+
+// stage shown to users outside of the survey
+type Start struct {
+	Command string `yaml:"command" json:"command"`
+	Message string `yaml:"message" json:"message"`
+}
+
+// greeting and the question whether user wants to take the survey
+type Welcome struct {
+	Message  string  `yaml:"message" json:"message"`
+	Question string  `yaml:"question" json:"question"`
+	Accept   string  `yaml:"accept" json:"accept"`
+	Decline  string  `yaml:"decline" json:"decline"`
+	Layout   *Layout `yaml:"layout" json:"layout"`
+}
+
+type Question struct {
+	Key     string   `yaml:"key" json:"key"`
+	Text    string   `yaml:"text" json:"text"`
+	Options []string `yaml:"options" json:"options"`
+	// option computed from the sender: sender_name or sender_contact
+	Default string `yaml:"default" json:"default"`
+	// key of the next question or "review", defaults to the following question
+	Next string `yaml:"next" json:"next"`
+	// label of the button on the review screen that opens this question again
+	Edit string `yaml:"edit" json:"edit"`
+	// name of the answer in the compact review, the text of the question if empty
+	Label string `yaml:"label" json:"label"`
+	// append provider and username of the sender to the submitted value
+	AppendSender bool `yaml:"append_sender" json:"append_sender"`
+	// checks of typed answers, predefined options are always accepted
+	Validate []Validation `yaml:"validate" json:"validate"`
+	// files accepted along with the text, attachments are rejected if not set
+	Attachments *Attachments `yaml:"attachments" json:"attachments"`
+	// button sharing the phone number of the user, the number becomes the answer
+	SharePhone *SharePhone `yaml:"share_phone" json:"share_phone"`
+	Layout     *Layout     `yaml:"layout" json:"layout"`
+}
+
+// tg sends the number of the account, vk takes it from the profile if it is visible
+type SharePhone struct {
+	Button string `yaml:"button" json:"button"`
+	// shown when the number couldnt be received, e.g. the platform has no such button
+	Message string `yaml:"message" json:"message"`
+}
+
+// references to the files are submitted with the answer, see conversation.Attachment
+type Attachments struct {
+	// photo, document, voice, audio, video, sticker or contact, any if empty
+	Types []string `yaml:"types" json:"types"`
+	// answer without attachments is not accepted
+	Required bool `yaml:"required" json:"required"`
+	// shown when the message has no or wrong attachments
+	Message string `yaml:"message" json:"message"`
+}
+
+// answer check, message is shown when the answer doesnt pass
+// types: non_empty, max_length(max), int_range(min, max), regex(pattern)
+type Validation struct {
+	Type    string `yaml:"type" json:"type"`
+	Min     *int   `yaml:"min" json:"min"`
+	Max     *int   `yaml:"max" json:"max"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Message string `yaml:"message" json:"message"`
+}
+
+// confirm screen with all the answers
+type Review struct {
+	Confirm string `yaml:"confirm" json:"confirm"`
+	Submit  string `yaml:"submit" json:"submit"`
+	Thanks  string `yaml:"thanks" json:"thanks"`
+	// one line per answer after the label of the question, long answers are cut
+	Compact bool    `yaml:"compact" json:"compact"`
+	Layout  *Layout `yaml:"layout" json:"layout"`
+}
+
+const (
+	DefaultSenderName    = "sender_name"
+	DefaultSenderContact = "sender_contact"
+)
+
+// loads definition from yaml or json file, format is chosen by extension
+func Load(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	def := &Definition{}
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(data, def)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, def)
+	default:
+		return nil, fmt.Errorf("unknown survey definition format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant parse survey definition %s: %w", path, err)
+	}
+	if err = def.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid survey definition %s: %w", path, err)
+	}
+	return def, nil
+}
+
+func (def *Definition) Validate() error {
+	if def.Start.Command == "" {
+		return fmt.Errorf("start command is empty")
+	}
+	if def.Cancel == "" || def.Welcome.Accept == "" || def.Review.Submit == "" {
+		return fmt.Errorf("cancel, welcome accept and review submit labels are required")
+	}
+	if len(def.Questions) == 0 {
+		return fmt.Errorf("survey has no questions")
+	}
+	keys := make(map[string]bool, len(def.Questions))
+	for _, q := range def.Questions {
+		if q.Key == "" {
+			return fmt.Errorf("question %q has no key", q.Text)
+		}
+		if isReservedStage(q.Key) {
+			return fmt.Errorf("question key %q is reserved", q.Key)
+		}
+		if keys[q.Key] {
+			return fmt.Errorf("duplicate question key %q", q.Key)
+		}
+		keys[q.Key] = true
+		switch q.Default {
+		case "", DefaultSenderName, DefaultSenderContact:
+		default:
+			return fmt.Errorf("question %q has unknown default %q", q.Key, q.Default)
+		}
+		for _, v := range q.Validate {
+			if _, err := v.validator(); err != nil {
+				return fmt.Errorf("question %q: %w", q.Key, err)
+			}
+		}
+		if err := q.Attachments.validate(); err != nil {
+			return fmt.Errorf("question %q: %w", q.Key, err)
+		}
+		if q.SharePhone != nil && (q.SharePhone.Button == "" || q.SharePhone.Message == "") {
+			return fmt.Errorf("question %q: share phone button and message are required", q.Key)
+		}
+	}
+	for _, q := range def.Questions {
+		if q.Next != "" && q.Next != ReviewStage && !keys[q.Next] {
+			return fmt.Errorf("question %q refers to unknown next question %q", q.Key, q.Next)
+		}
+	}
+	return nil
+}
+
+// key of the question following q
+func (def *Definition) next(i int) string {
+	if q := def.Questions[i]; q.Next != "" {
+		return q.Next
+	}
+	if i+1 < len(def.Questions) {
+		return def.Questions[i+1].Key
+	}
+	return ReviewStage
+}
+
+func (v Validation) validator() (conversation.Validator, error) {
+	if v.Message == "" {
+		return conversation.Validator{}, fmt.Errorf("%s validation has no message", v.Type)
+	}
+	switch v.Type {
+	case "non_empty":
+		return conversation.NonEmpty(v.Message), nil
+	case "max_length":
+		if v.Max == nil {
+			return conversation.Validator{}, fmt.Errorf("max_length validation requires max")
+		}
+		return conversation.MaxLength(*v.Max, v.Message), nil
+	case "int_range":
+		min, max := math.MinInt, math.MaxInt
+		if v.Min != nil {
+			min = *v.Min
+		}
+		if v.Max != nil {
+			max = *v.Max
+		}
+		return conversation.IntRange(min, max, v.Message), nil
+	case "regex":
+		re, err := regexp.Compile(v.Pattern)
+		if err != nil {
+			return conversation.Validator{}, fmt.Errorf("bad regex validation: %w", err)
+		}
+		return conversation.Regexp(re, v.Message), nil
+	}
+	return conversation.Validator{}, fmt.Errorf("unknown validation %q", v.Type)
+}
+
+func (q Question) validators() []conversation.Validator {
+	validators := make([]conversation.Validator, 0, len(q.Validate))
+	for _, v := range q.Validate {
+		// definition is validated before compilation
+		validator, _ := v.validator()
+		validators = append(validators, validator)
+	}
+	return validators
+}
+
+func (a *Attachments) validate() error {
+	if a == nil {
+		return nil
+	}
+	if a.Message == "" {
+		return fmt.Errorf("attachments have no message")
+	}
+	for _, t := range a.Types {
+		switch conversation.AttachmentType(t) {
+		case conversation.PhotoAttachment, conversation.DocumentAttachment, conversation.VoiceAttachment,
+			conversation.AudioAttachment, conversation.VideoAttachment, conversation.StickerAttachment,
+			conversation.ContactAttachment:
+		default:
+			return fmt.Errorf("unknown attachment type %q", t)
+		}
+	}
+	return nil
+}
+
+func (q Question) attachmentPolicy(def *Definition) conversation.AttachmentPolicy {
+	if q.Attachments == nil {
+		message := def.AttachmentMessage
+		if message == "" {
+			message = conversation.DefaultAttachmentMessage
+		}
+		return conversation.RejectAttachments(message)
+	}
+	types := make([]conversation.AttachmentType, len(q.Attachments.Types))
+	for i, t := range q.Attachments.Types {
+		types[i] = conversation.AttachmentType(t)
+	}
+	return conversation.AttachmentPolicy{
+		Accept:   true,
+		Types:    types,
+		Required: q.Attachments.Required,
+		Message:  q.Attachments.Message,
+	}
+}
@@ -0,0 +1,329 @@
+package survey
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+)
+
+const (
+	StartStage   = "start"
+	WelcomeStage = "welcome"
+	ReviewStage  = "review"
+
+	// longer answers are not offered as a button, vk doesnt allow labels over 40 characters
+	maxOptionLength = 40
+	// suffix of the key the attachments of the answer are saved under
+	filesKeySuffix = "#files"
+	// suffix of the key the phone number shared with the contact button is saved under
+	phoneKeySuffix = "#phone"
+)
+
+func isReservedStage(name string) bool {
+	return name == StartStage || name == WelcomeStage || name == ReviewStage
+}
+
+type Answer struct {
+	Key      string
+	Question string
+	Value    interface{}
+	// references to the attached files, see conversation.Attachment.String
+	Files []string
+	// number shared with the contact button by the sender, empty if the answer was typed
+	Phone string
+}
+
+// completed survey passed to the sink
+type Submission struct {
+	ChatID   string
+	Provider string
+	Sender   conversation.User
+	Time     time.Time
+	Answers  []Answer
+}
+
+type Sink interface {
+	Submit(s Submission) error
+}
+
+// survey compiled into conversation stages
+type Survey struct {
+	def    *Definition
+	sink   Sink
+	stages *conversation.StageRegistry
+}
+
+// compiles definition into stages, sink is picked from sinks by the name in the definition
+func Compile(def *Definition, sinks map[string]Sink) (*Survey, error) {
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	sink, found := sinks[def.Sink]
+	if !found {
+		return nil, fmt.Errorf("unknown survey sink %q", def.Sink)
+	}
+	s := &Survey{
+		def:    def,
+		sink:   sink,
+		stages: conversation.NewStageRegistry(),
+	}
+	s.stages.Register(StartStage, s.newStartQuestion)
+	s.stages.Register(WelcomeStage, s.newWelcomeQuestion)
+	for i := range def.Questions {
+		s.stages.Register(def.Questions[i].Key, s.newQuestion(i))
+	}
+	s.stages.Register(ReviewStage, s.newReviewQuestion)
+	return s, nil
+}
+
+func (s *Survey) Stages() *conversation.StageRegistry {
+	return s.stages
+}
+
+func (s *Survey) EntryPoint() func() conversation.Handler {
+	return s.stages.EntryPoint(StartStage)
+}
+
+func (s *Survey) newStartQuestion(params conversation.StageParams, ctx conversation.Ctx) conversation.Handler {
+	handlers := conversation.OptionsHandlers{
+		{Text: s.def.Start.Command, Action: s.stages.TransitionAction(WelcomeStage, nil)},
+	}
+	return conversation.NewOptionsHandler(conversation.EmptyAction(), s.def.Start.Message, handlers, s.stages.ResetAction(StartStage, nil)).
+		SetLayout(s.def.Layout.layout())
+}
+
+func (s *Survey) newWelcomeQuestion(params conversation.StageParams, ctx conversation.Ctx) conversation.Handler {
+	cancel := s.finish()
+	handlers := conversation.OptionsHandlers{
+		{Text: s.def.Welcome.Accept, Style: conversation.PrimaryButton, Action: s.stages.TransitionAction(s.def.Questions[0].Key, nil)},
+	}
+	if s.def.Welcome.Decline != "" {
+		handlers = append(handlers, conversation.Option{Text: s.def.Welcome.Decline, Action: cancel})
+	}
+	handlers = append(handlers, s.cancelOption())
+	welcome := conversation.EmptyAction()
+	if s.def.Welcome.Message != "" {
+		welcome = conversation.SendTextAction(s.def.Welcome.Message, welcome)
+	}
+	return conversation.NewOptionsHandler(welcome, s.def.Welcome.Question, handlers, conversation.EmptyAction()).
+		SetLayout(s.def.Welcome.Layout.or(s.def.Layout).layout())
+}
+
+func (s *Survey) cancelOption() conversation.Option {
+	return conversation.Option{
+		Text:   s.def.Cancel,
+		Style:  conversation.NegativeButton,
+		Action: s.finish(),
+	}
+}
+
+// back to the start, answers are forgotten and the session is closed so nothing of it
+// stays in the session store, the next update starts over from the start stage
+func (s *Survey) finish() conversation.Action {
+	return func(answer string, ctx conversation.Ctx) error {
+		ctx.ClearKeys()
+		ctx.Close()
+		return s.stages.Stage(StartStage, nil).Welcome(ctx)
+	}
+}
+
+// cancel, and back if definition has it
+func (s *Survey) navigationOptions() conversation.OptionsHandlers {
+	options := make(conversation.OptionsHandlers, 0, 2)
+	if s.def.Back != "" {
+		options = append(options, conversation.Option{Text: s.def.Back, Action: conversation.BackAction()})
+	}
+	return append(options, s.cancelOption())
+}
+
+func (s *Survey) newQuestion(i int) conversation.StageBuilder {
+	q := s.def.Questions[i]
+	validators := q.validators()
+	policy := q.attachmentPolicy(s.def)
+	optionsPolicy := policy
+	if q.SharePhone != nil {
+		// contact of the share phone button comes as an attachment
+		optionsPolicy.Accept = true
+		if len(policy.Types) > 0 || !policy.Accept {
+			optionsPolicy.Types = append(slices.Clip(policy.Types), conversation.ContactAttachment)
+		}
+	}
+	layout := q.Layout.or(s.def.Layout).layout()
+	return func(params conversation.StageParams, ctx conversation.Ctx) conversation.Handler {
+		// question opened from the review screen returns there
+		save := conversation.SaveKeyAction(q.Key, conversation.ReturnAction(s.stages.TransitionAction(s.def.next(i), nil)))
+		if q.Attachments != nil {
+			// every answer replaces the files of the previous one
+			save = conversation.SaveAttachmentsAction(q.Key+filesKeySuffix, save)
+		}
+		typed := save
+		if q.SharePhone != nil {
+			// typed number is not the verified one anymore
+			typed = func(answer string, ctx conversation.Ctx) error {
+				ctx.SetKey(q.Key+phoneKeySuffix, "")
+				return save(answer, ctx)
+			}
+		}
+		validated := conversation.ValidateAction(validators, typed)
+		// validators check the text, a file without a caption is an answer on its own
+		answer := conversation.AttachmentsAction(policy, func(answer string, ctx conversation.Ctx) error {
+			if answer == "" && len(ctx.Update().GetAttachments()) > 0 {
+				return typed(answer, ctx)
+			}
+			return validated(answer, ctx)
+		})
+		handlers := make(conversation.OptionsHandlers, 0, len(q.Options)+5)
+		// previous answer when user came back to the question, unless it came with files
+		// it keeps the shared number if it was one
+		if value, found := ctx.GetKey(q.Key); found && len(files(ctx, q.Key)) == 0 {
+			if text := fmt.Sprint(value); utf8.RuneCountInString(text) <= maxOptionLength {
+				handlers = append(handlers, conversation.Option{Text: text, Action: save})
+			}
+		}
+		if q.SharePhone != nil {
+			share := s.sharePhoneAction(q, save)
+			handlers = append(handlers, conversation.Option{Text: q.SharePhone.Button, Style: conversation.PrimaryButton, RequestContact: true, Action: share})
+			// tg sends the contact without the text of the button
+			withoutContact := answer
+			answer = func(text string, ctx conversation.Ctx) error {
+				if _, found := conversation.SharedContact(ctx.Update().GetAttachments()); found {
+					return share(text, ctx)
+				}
+				return withoutContact(text, ctx)
+			}
+		}
+		if option := defaultOption(q.Default, ctx.Update()); option != "" {
+			handlers = append(handlers, conversation.Option{Text: option, Action: typed})
+		}
+		for _, option := range q.Options {
+			handlers = append(handlers, conversation.Option{Text: option, Action: typed})
+		}
+		handlers = append(handlers, s.navigationOptions()...)
+		return conversation.NewOptionsHandler(conversation.EmptyAction(), q.Text, handlers, answer).
+			SetAttachmentPolicy(optionsPolicy).
+			SetLayout(layout)
+	}
+}
+
+// saves the shared number as the answer, contacts of other people are saved as typed numbers
+func (s *Survey) sharePhoneAction(q Question, save conversation.Action) conversation.Action {
+	return func(answer string, ctx conversation.Ctx) error {
+		contact, found := conversation.SharedContact(ctx.Update().GetAttachments())
+		if !found {
+			return ctx.Update().Reply(q.SharePhone.Message)
+		}
+		phone := ""
+		if contact.Verified {
+			phone = contact.Phone
+		}
+		ctx.SetKey(q.Key+phoneKeySuffix, phone)
+		return save(contact.Phone, ctx)
+	}
+}
+
+func defaultOption(kind string, update conversation.Update) string {
+	switch kind {
+	case DefaultSenderName:
+		return strings.TrimSpace(update.GetSender().FullName())
+	case DefaultSenderContact:
+		if username := update.GetSender().UserName; len(username) > 0 {
+			return fmt.Sprint(update.Provider(), ": ", username)
+		}
+	}
+	return ""
+}
+
+// attachments saved with the answer to the question
+func files(ctx conversation.Ctx, key string) []string {
+	value, _ := ctx.GetKey(key + filesKeySuffix)
+	return conversation.AttachmentRefs(value)
+}
+
+// all the answers followed by the confirm message
+func (s *Survey) summary(ctx conversation.Ctx) string {
+	var summary strings.Builder
+	for _, q := range s.def.Questions {
+		value, _ := ctx.GetKey(q.Key)
+		answer := fmt.Sprint(value)
+		n := len(files(ctx, q.Key))
+		if s.def.Review.Compact {
+			label := q.Label
+			if label == "" {
+				label = q.Text
+			}
+			fmt.Fprintf(&summary, "**%s:** %s", label, conversation.EscapeMarkup(conversation.ShortAnswer(answer)))
+			if n > 0 {
+				fmt.Fprintf(&summary, " 📎 %d", n)
+			}
+			summary.WriteString("\n")
+			continue
+		}
+		fmt.Fprintf(&summary, "**%s**\n%s\n", q.Text, conversation.EscapeMarkup(answer))
+		if n > 0 {
+			fmt.Fprintf(&summary, "📎 %d\n", n)
+		}
+		summary.WriteString("\n")
+	}
+	if s.def.Review.Compact {
+		summary.WriteString("\n")
+	}
+	summary.WriteString(s.def.Review.Confirm)
+	return summary.String()
+}
+
+func (s *Survey) newReviewQuestion(params conversation.StageParams, ctx conversation.Ctx) conversation.Handler {
+	handlers := conversation.OptionsHandlers{
+		{Text: s.def.Review.Submit, Style: conversation.PrimaryButton, Action: s.submit},
+	}
+	for _, q := range s.def.Questions {
+		if q.Edit != "" {
+			handlers = append(handlers, conversation.Option{Text: q.Edit, Action: s.stages.CallAction(q.Key, nil)})
+		}
+	}
+	handlers = append(handlers, s.navigationOptions()...)
+	return conversation.NewOptionsHandler(conversation.EmptyAction(), s.summary(ctx), handlers, conversation.EmptyAction()).
+		SetLayout(s.def.Review.Layout.or(s.def.Layout).layout())
+}
+
+func (s *Survey) submission(ctx conversation.Ctx) Submission {
+	update := ctx.Update()
+	sub := Submission{
+		ChatID:   update.ChatID(),
+		Provider: update.Provider(),
+		Sender:   update.GetSender(),
+		Time:     time.Now(),
+		Answers:  make([]Answer, len(s.def.Questions)),
+	}
+	for i, q := range s.def.Questions {
+		value, _ := ctx.GetKey(q.Key)
+		if q.AppendSender {
+			value = fmt.Sprintf("%v (%s: %s)", value, sub.Provider, sub.Sender.UserName)
+		}
+		phone, _ := ctx.GetKey(q.Key + phoneKeySuffix)
+		sub.Answers[i] = Answer{Key: q.Key, Question: q.Text, Value: value, Files: files(ctx, q.Key)}
+		if phone, ok := phone.(string); ok {
+			sub.Answers[i].Phone = phone
+		}
+	}
+	return sub
+}
+
+// on failure user stays on the review screen and can submit again,
+// once the answers are written failed thanks only gets logged so they are not submitted twice
+func (s *Survey) submit(answer string, ctx conversation.Ctx) error {
+	if err := s.sink.Submit(s.submission(ctx)); err != nil {
+		return fmt.Errorf("cant write survey results: %w", err)
+	}
+	if err := ctx.Update().Reply(s.def.Review.Thanks); err != nil {
+		log.Printf("chat %s: survey submitted, cant send thanks: %v", ctx.Update().ChatID(), err)
+	}
+	if err := s.finish()(answer, ctx); err != nil {
+		log.Printf("chat %s: survey submitted, cant show the start: %v", ctx.Update().ChatID(), err)
+	}
+	return nil
+}
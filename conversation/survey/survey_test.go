@@ -0,0 +1,451 @@
+package survey_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+	"github.com/spanditime/go-survey-bot/conversation/conversationtest"
+	"github.com/spanditime/go-survey-bot/conversation/survey"
+)
+
+// sink failing the first failures submissions
+type recordingSink struct {
+	mu          sync.Mutex
+	failures    int
+	submissions []survey.Submission
+}
+
+func (s *recordingSink) Submit(sub survey.Submission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink is down")
+	}
+	s.submissions = append(s.submissions, sub)
+	return nil
+}
+
+func (s *recordingSink) answers() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []map[string]string{}
+	for _, sub := range s.submissions {
+		answers := make(map[string]string, len(sub.Answers))
+		for _, answer := range sub.Answers {
+			answers[answer.Key] = fmt.Sprint(answer.Value)
+			if len(answer.Files) > 0 {
+				answers[answer.Key+" files"] = fmt.Sprint(answer.Files)
+			}
+			if answer.Phone != "" {
+				answers[answer.Key+" phone"] = answer.Phone
+			}
+		}
+		result = append(result, answers)
+	}
+	return result
+}
+
+func startSurvey(t *testing.T, sink survey.Sink) *conversationtest.Agent {
+	t.Helper()
+	return startEditedSurvey(t, sink, func(*survey.Definition) {})
+}
+
+// survey from testdata changed by edit
+func startEditedSurvey(t *testing.T, sink survey.Sink, edit func(*survey.Definition), middleware ...conversation.Middleware) *conversationtest.Agent {
+	t.Helper()
+	manager, _ := newManager(t, sink, edit)
+	manager.Use(middleware...)
+	return conversationtest.Start(t, manager)
+}
+
+func newManager(t *testing.T, sink survey.Sink, edit func(*survey.Definition)) (*conversation.Manager, *survey.Survey) {
+	t.Helper()
+	def, err := survey.Load("testdata/survey.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(def)
+	s, err := survey.Compile(def, map[string]survey.Sink{"test": sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := conversation.NewManager(s.EntryPoint())
+	manager.SetErrorMessage(def.ErrorMessage)
+	return manager, s
+}
+
+var (
+	reviewOptions = []string{"Submit", "Edit name", "Edit age", "Edit referral", "Edit contact", "Back", "Cancel"}
+	photo         = []conversation.Attachment{{Type: conversation.PhotoAttachment, ID: "p1"}}
+	ownContact    = []conversation.Attachment{{Type: conversation.ContactAttachment, Phone: "+70001112233", Verified: true}}
+
+	toReview = conversationtest.Script{
+		{Say: "/start", Expect: "Take the survey?", Contains: "Hello", Options: []string{"Yes", "No", "Cancel"}},
+		{Say: "Yes", Expect: "Name?", Options: []string{"Test User", "Back", "Cancel"}},
+		{Say: "Ann", Expect: "Age?", Options: []string{"Back", "Cancel"}},
+		{Say: "thirty", Expect: "Age?", Contains: "Age must be a number"},
+		{Say: "30", Expect: "City?", Options: []string{"Dubna", "Moscow", "Back", "Cancel"}},
+		{Say: "Dubna", Expect: "Referral?", Options: []string{"None", "Back", "Cancel"}},
+		{Say: "None", Expect: "Contact?", Options: []string{"Share phone", "test: tester", "Back", "Cancel"}},
+		{Say: "test: tester", Contains: "Age?**\n30\n", Options: reviewOptions},
+	}
+)
+
+func script(parts ...conversationtest.Script) conversationtest.Script {
+	var result conversationtest.Script
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func TestSurvey(t *testing.T) {
+	ann := map[string]string{"name": "Ann", "age": "30", "city": "Dubna", "referral": "None", "contact": "test: tester (test: tester)"}
+	tests := []struct {
+		name     string
+		failures int
+		script   conversationtest.Script
+		want     []map[string]string
+	}{
+		{
+			name: "full survey",
+			script: script(toReview, conversationtest.Script{
+				{Say: "Submit", Expect: "Use /start to begin", Contains: "Thanks", Options: []string{"/start"}},
+			}),
+			want: []map[string]string{ann},
+		},
+		{
+			name: "edit answers from review",
+			script: script(toReview, conversationtest.Script{
+				{Say: "Edit age", Expect: "Age?", Options: []string{"30", "Back", "Cancel"}},
+				{Say: "31", Contains: "Age?**\n31\n", Options: reviewOptions},
+				{Say: "Edit name", Expect: "Name?", Options: []string{"Ann", "Test User", "Back", "Cancel"}},
+				{Say: "Ann", Contains: "Name?**\nAnn\n", Options: reviewOptions},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{
+				{"name": "Ann", "age": "31", "city": "Dubna", "referral": "None", "contact": "test: tester (test: tester)"},
+			},
+		},
+		{
+			name: "answers are not read as markup",
+			script: script(toReview, conversationtest.Script{
+				{Say: "Edit name", Expect: "Name?"},
+				{Say: "**Ann**", Contains: "Name?**\n\\*\\*Ann\\*\\*\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{
+				{"name": "**Ann**", "age": "30", "city": "Dubna", "referral": "None", "contact": "test: tester (test: tester)"},
+			},
+		},
+		{
+			name: "back to previous question",
+			script: script(toReview[:3], conversationtest.Script{
+				{Say: "Back", Expect: "Name?", Options: []string{"Ann", "Test User", "Back", "Cancel"}},
+				{Say: "Back", Expect: "Take the survey?"},
+			}),
+			want: []map[string]string{},
+		},
+		{
+			name: "cancel in the middle",
+			script: script(toReview[:3], conversationtest.Script{
+				{Say: "Cancel", Expect: "Use /start to begin", Options: []string{"/start"}},
+				{Say: "Ann", Expect: "Use /start to begin"},
+			}),
+			want: []map[string]string{},
+		},
+		{
+			name: "cancel on review",
+			script: script(toReview, conversationtest.Script{
+				{Say: "Cancel", Expect: "Use /start to begin"},
+			}),
+			want: []map[string]string{},
+		},
+		{
+			name: "decline",
+			script: script(toReview[:1], conversationtest.Script{
+				{Say: "No", Expect: "Use /start to begin"},
+			}),
+			want: []map[string]string{},
+		},
+		{
+			name: "files are rejected where text is expected",
+			script: script(toReview[:2], conversationtest.Script{
+				{Say: "", Attach: photo, Expect: "Name?", Contains: "Please answer with text"},
+				{Say: "Ann", Attach: photo, Expect: "Name?", Contains: "Please answer with text"},
+				// caption matching an option doesnt make the photo an option
+				{Say: "Test User", Attach: photo, Expect: "Name?", Contains: "Please answer with text"},
+				{Say: "Ann", Expect: "Age?"},
+			}),
+			want: []map[string]string{},
+		},
+		{
+			name: "files are accepted as an answer",
+			script: script(toReview[:6], conversationtest.Script{
+				{Say: "", Attach: []conversation.Attachment{{Type: conversation.VoiceAttachment, ID: "v1"}}, Expect: "Referral?", Contains: "Only photos and documents"},
+				{Say: "", Attach: photo, Expect: "Contact?"},
+				{Say: "Back", Expect: "Referral?", Options: []string{"None", "Back", "Cancel"}},
+				{Say: "from the clinic", Attach: []conversation.Attachment{photo[0], {Type: conversation.DocumentAttachment, URL: "https://example.org/doc.pdf"}}, Expect: "Contact?"},
+				{Say: "test: tester", Contains: "Referral?**\nfrom the clinic\n📎 2\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{
+				{"name": "Ann", "age": "30", "city": "Dubna", "referral": "from the clinic", "referral files": "[photo:p1 https://example.org/doc.pdf]", "contact": "test: tester (test: tester)"},
+			},
+		},
+		{
+			name: "shared phone number",
+			script: script(toReview[:7], conversationtest.Script{
+				{Say: "Share phone", Expect: "Contact?", Contains: "No phone number"},
+				{Say: "", Attach: ownContact, Contains: "Contact?**\n+70001112233\n", Options: reviewOptions},
+				{Say: "Edit contact", Expect: "Contact?", Options: []string{"+70001112233", "Share phone", "test: tester", "Back", "Cancel"}},
+				{Say: "+70001112233", Contains: "Contact?**\n+70001112233\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{
+				{"name": "Ann", "age": "30", "city": "Dubna", "referral": "None", "contact": "+70001112233 (test: tester)", "contact phone": "+70001112233"},
+			},
+		},
+		{
+			name: "typed or foreign number is not verified",
+			script: script(toReview[:7], conversationtest.Script{
+				{Say: "", Attach: ownContact, Contains: "Contact?**\n+70001112233\n"},
+				{Say: "Edit contact", Expect: "Contact?"},
+				{Say: "", Attach: []conversation.Attachment{{Type: conversation.ContactAttachment, Phone: "+79998887766"}}, Contains: "Contact?**\n+79998887766\n"},
+				{Say: "Edit contact", Expect: "Contact?"},
+				{Say: "+70001112233", Contains: "Contact?**\n+70001112233\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{
+				{"name": "Ann", "age": "30", "city": "Dubna", "referral": "None", "contact": "+70001112233 (test: tester)"},
+			},
+		},
+		{
+			name:     "submit again after sink failure",
+			failures: 1,
+			script: script(toReview, conversationtest.Script{
+				{Say: "Submit", Expect: "Something went wrong"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			want: []map[string]string{ann},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{failures: tt.failures}
+			agent := startSurvey(t, sink)
+			agent.Play(t, "chat", tt.script)
+			if got := sink.answers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("submitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompactReview(t *testing.T) {
+	agent := startEditedSurvey(t, &recordingSink{}, func(def *survey.Definition) {
+		def.Review.Compact = true
+		def.Questions[1].Label = "Age"
+	})
+	long := strings.Repeat("a", 120)
+	agent.Play(t, "chat", script(toReview[:2], conversationtest.Script{
+		{Say: long + "\nsecond line", Expect: "Age?"},
+		{Say: "30", Expect: "City?"},
+		{Say: "Dubna", Expect: "Referral?"},
+		{Say: "None", Expect: "Contact?"},
+		{Say: "test: tester", Expect: "**Name?:** " + strings.Repeat("a", 100) + "…\n**Age:** 30\n**City?:** Dubna\n" +
+			"**Referral?:** None\n**Contact?:** test: tester\n\nCorrect?", Options: reviewOptions},
+	}))
+}
+
+// update failing to send the given text
+type failingReply struct {
+	conversation.Update
+	text string
+}
+
+func (upd failingReply) Reply(text string) error {
+	if text == upd.text {
+		return errors.New("message dropped")
+	}
+	return upd.Update.Reply(text)
+}
+
+func TestFailedThanksDoesntSubmitTwice(t *testing.T) {
+	sink := &recordingSink{}
+	agent := startEditedSurvey(t, sink, func(*survey.Definition) {}, func(next conversation.UpdateHandler) conversation.UpdateHandler {
+		return func(ctx conversation.Ctx) error {
+			return next(conversation.WithUpdate(ctx, failingReply{Update: ctx.Update(), text: "Thanks"}))
+		}
+	})
+	agent.Play(t, "chat", script(toReview, conversationtest.Script{
+		{Say: "Submit", Expect: "Use /start to begin", Options: []string{"/start"}},
+		{Say: "Submit", Expect: "Use /start to begin"},
+	}))
+	if got := len(sink.answers()); got != 1 {
+		t.Errorf("got %d submissions, want 1", got)
+	}
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	sink := &recordingSink{}
+	// every run is a restart of the bot with the same session file
+	run := func(name string, play func(t *testing.T, agent *conversationtest.Agent)) {
+		t.Run(name, func(t *testing.T) {
+			manager, s := newManager(t, sink, func(*survey.Definition) {})
+			store, err := conversation.NewBoltStore(path, s.Stages())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			manager.SetSessionStore(store)
+			play(t, conversationtest.Start(t, manager))
+		})
+	}
+
+	run("start", func(t *testing.T, agent *conversationtest.Agent) {
+		agent.Play(t, "chat", toReview[:3])
+	})
+	run("finish", func(t *testing.T, agent *conversationtest.Agent) {
+		agent.Play(t, "chat", script(toReview[3:], conversationtest.Script{
+			{Say: "Back", Expect: "Contact?"},
+			{Say: "test: tester", Contains: "Name?**\nAnn\n", Options: reviewOptions},
+			{Say: "Submit", Contains: "Thanks"},
+		}))
+	})
+	if got := sink.answers(); len(got) != 1 || got[0]["name"] != "Ann" || got[0]["age"] != "30" {
+		t.Errorf("got %v, want answers given before and after the restart", got)
+	}
+
+	_, s := newManager(t, sink, func(*survey.Definition) {})
+	store, err := conversation.NewBoltStore(path, s.Stages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if sess, err := store.Load("chat"); err != nil || sess != nil {
+		t.Errorf("got %v, %v, want the submitted session to be deleted", sess, err)
+	}
+}
+
+func TestCancelledSurveyLeavesNoSession(t *testing.T) {
+	manager, _ := newManager(t, &recordingSink{}, func(*survey.Definition) {})
+	store := conversation.NewMemoryStore()
+	manager.SetSessionStore(store)
+	agent := conversationtest.Start(t, manager)
+	agent.Play(t, "chat", script(toReview[:3], conversationtest.Script{
+		{Say: "Cancel", Expect: "Use /start to begin", Options: []string{"/start"}},
+	}))
+	if sess, _ := store.Load("chat"); sess != nil {
+		t.Errorf("cancelled session stays in the store: %+v", sess)
+	}
+
+	agent.Play(t, "chat", conversationtest.Script{
+		{Say: "/start", Expect: "Take the survey?"},
+	})
+	if sess, _ := store.Load("chat"); sess == nil {
+		t.Error("new survey has no session")
+	}
+}
+
+func TestSurveyChatsAreIndependent(t *testing.T) {
+	sink := &recordingSink{}
+	agent := startSurvey(t, sink)
+	agent.Play(t, "first", toReview[:3])
+	agent.Play(t, "second", toReview[:1])
+	agent.Play(t, "first", toReview[3:5])
+	agent.Play(t, "second", conversationtest.Script{
+		{Say: "Yes", Expect: "Name?"},
+	})
+}
+
+func TestRecordedTranscriptReplays(t *testing.T) {
+	compact := func(def *survey.Definition) { def.Review.Compact = true }
+	tests := []struct {
+		name    string
+		edit    func(*survey.Definition)
+		script  conversationtest.Script
+		private []string
+	}{
+		{
+			name: "review",
+			edit: func(*survey.Definition) {},
+			script: script(toReview[:2], conversationtest.Script{
+				{Say: "Анна Иванова", Expect: "Age?"},
+			}, toReview[3:], conversationtest.Script{
+				{Say: "Edit name", Expect: "Name?", Options: []string{"Анна Иванова", "Test User", "Back", "Cancel"}},
+				{Say: "Анна Иванова", Contains: "Name?**\nАнна Иванова\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			private: []string{"Анна", "Иванова"},
+		},
+		{
+			name: "compact review of a long answer",
+			edit: compact,
+			script: script(toReview[:2], conversationtest.Script{
+				{Say: "Annabelle Secretname\nsecond line", Expect: "Age?"},
+			}, toReview[3:7], conversationtest.Script{
+				{Say: "test: tester", Contains: "**Name?:** Annabelle Secretname…\n"},
+				{Say: "Submit", Contains: "Thanks"},
+			}),
+			private: []string{"Annabelle", "Secretname", "second line"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "transcript.jsonl")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run("record", func(t *testing.T) {
+				agent := startEditedSurvey(t, &recordingSink{}, tt.edit, conversation.RecordingMiddleware(file))
+				agent.Play(t, "chat", tt.script)
+			})
+			file.Close()
+
+			recorded, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, private := range tt.private {
+				if strings.Contains(string(recorded), private) {
+					t.Errorf("typed answer %q is recorded:\n%s", private, recorded)
+				}
+			}
+			manager, _ := newManager(t, &recordingSink{}, tt.edit)
+			conversationtest.Replay(t, manager, path)
+		})
+	}
+}
+
+func TestTranscripts(t *testing.T) {
+	paths, err := filepath.Glob("testdata/transcripts/*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			def, err := survey.Load("testdata/survey.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := survey.Compile(def, map[string]survey.Sink{"test": &recordingSink{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			manager := conversation.NewManager(s.EntryPoint())
+			manager.SetErrorMessage(def.ErrorMessage)
+			conversationtest.Replay(t, manager, path)
+		})
+	}
+}
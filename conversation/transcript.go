@@ -0,0 +1,241 @@
+package conversation
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// one handled update of a recorded conversation
+type TranscriptEntry struct {
+	// anonymized chat id, stable within one recording
+	Chat     string `json:"chat"`
+	Provider string `json:"provider"`
+	Say      string `json:"say"`
+	// types of the attachments, files themselves are not recorded
+	Attachments []AttachmentType  `json:"attachments,omitempty"`
+	Replies     []TranscriptReply `json:"replies"`
+	// handling failed, the error message sent by the manager is not recorded
+	Error bool `json:"error,omitempty"`
+}
+
+type TranscriptReply struct {
+	Text     string     `json:"text"`
+	Keyboard [][]string `json:"keyboard,omitempty"`
+	// reply hides the keyboard, see Update.ReplyRemovingKeyboard
+	RemoveKeyboard bool `json:"remove_keyboard,omitempty"`
+}
+
+// sender of recorded conversations, real names are replaced with it
+var AnonymousUser = User{
+	Name:     "Test",
+	Surname:  "User",
+	Id:       "1",
+	UserName: "tester",
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d\-\s()]{8,}\d`)
+)
+
+const (
+	anonymousEmail = "user@example.org"
+	anonymousPhone = "+70000000000"
+	// chats whose buttons and typed answers are remembered, more are forgotten
+	maxRecordedChats = 10000
+	// shorter answers are masked in messages but not looked for in replies,
+	// they would match the texts of the bot
+	minMaskedLength = 3
+)
+
+// what the recorder knows about a chat
+type recordedChat struct {
+	// texts of the buttons shown last, pressing one is not a typed answer
+	buttons map[string]bool
+	// anonymized typed answers, masked wherever they come back in the replies
+	answers []string
+}
+
+// writes every handled update with the replies to w as json lines, see TranscriptEntry
+// sender names, chat ids, emails and phone numbers are anonymized, typed answers are masked
+// so transcripts of real conversations can be kept as regression tests
+func RecordingMiddleware(w io.Writer) Middleware {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	var mu sync.Mutex
+	chats := make(map[string]*recordedChat)
+	return func(next UpdateHandler) UpdateHandler {
+		return func(ctx Ctx) error {
+			update := &recordingUpdate{Update: ctx.Update()}
+			err := next(WithUpdate(ctx, update))
+
+			mu.Lock()
+			chat, found := chats[update.ChatID()]
+			if !found {
+				if len(chats) >= maxRecordedChats {
+					clear(chats)
+				}
+				chat = &recordedChat{buttons: make(map[string]bool)}
+				chats[update.ChatID()] = chat
+			}
+			anonymize := anonymizer(update.GetSender())
+			say := anonymize(update.GetMessage())
+			if chat.typed(update.GetMessage(), say) {
+				chat.answers = append(chat.answers, say)
+				say = maskAnswer(say)
+			}
+			mask := chat.masker()
+			entry := TranscriptEntry{
+				Chat:     anonymousChat(salt, update.ChatID()),
+				Provider: update.Provider(),
+				Say:      say,
+				Replies:  make([]TranscriptReply, 0, len(update.replies)),
+				Error:    err != nil,
+			}
+			for _, a := range update.GetAttachments() {
+				entry.Attachments = append(entry.Attachments, a.Type)
+			}
+			for _, reply := range update.replies {
+				if reply.RemoveKeyboard || len(reply.Keyboard) > 0 {
+					clear(chat.buttons)
+				}
+				reply.Text = mask(anonymize(reply.Text))
+				for _, row := range reply.Keyboard {
+					for i := range row {
+						chat.buttons[row[i]] = true
+						row[i] = mask(anonymize(row[i]))
+					}
+				}
+				entry.Replies = append(entry.Replies, reply)
+			}
+			mu.Unlock()
+			data, jsonErr := json.Marshal(entry)
+			if jsonErr == nil {
+				mu.Lock()
+				w.Write(append(data, '\n'))
+				mu.Unlock()
+			}
+			return err
+		}
+	}
+}
+
+func anonymousChat(salt []byte, chatID string) string {
+	sum := sha256.Sum256(append(append([]byte(nil), salt...), chatID...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// text was typed rather than sent with a button, commands are not answers
+func (chat *recordedChat) typed(text, anonymized string) bool {
+	if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "/") {
+		return false
+	}
+	// previous answer is offered as a button, pressing it sends the answer again
+	return !chat.buttons[text] || slices.Contains(chat.answers, anonymized)
+}
+
+// masks typed answers of the chat as whole words, e.g. in the review of all answers,
+// short forms of the compact review too
+func (chat *recordedChat) masker() func(string) string {
+	patterns := []*regexp.Regexp{}
+	for _, answer := range chat.answers {
+		short := ShortAnswer(answer)
+		for _, text := range []string{answer, EscapeMarkup(answer), short, EscapeMarkup(short)} {
+			if utf8.RuneCountInString(text) >= minMaskedLength {
+				patterns = append(patterns, regexp.MustCompile(`(^|[^\pL\pN])`+regexp.QuoteMeta(text)+`($|[^\pL\pN])`))
+			}
+		}
+	}
+	return func(text string) string {
+		for _, p := range patterns {
+			text = p.ReplaceAllStringFunc(text, maskAnswer)
+		}
+		return text
+	}
+}
+
+// letters are replaced with x, length, digits and punctuation stay
+// so the replayed answer passes the same validators
+func maskAnswer(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r) && unicode.IsUpper(r):
+			return 'Х'
+		case unicode.Is(unicode.Cyrillic, r):
+			return 'х'
+		case unicode.IsUpper(r):
+			return 'X'
+		case unicode.IsLetter(r):
+			return 'x'
+		}
+		return r
+	}, text)
+}
+
+func anonymizer(sender User) func(string) string {
+	// parts of the name alone are too short to be replaced safely
+	pairs := []string{}
+	for _, p := range [][2]string{
+		{strings.TrimSpace(sender.FullName()), strings.TrimSpace(AnonymousUser.FullName())},
+		{sender.UserName, AnonymousUser.UserName},
+	} {
+		if p[0] != "" {
+			pairs = append(pairs, p[0], p[1])
+		}
+	}
+	replacer := strings.NewReplacer(pairs...)
+	return func(text string) string {
+		text = emailPattern.ReplaceAllString(text, anonymousEmail)
+		text = phonePattern.ReplaceAllString(text, anonymousPhone)
+		return replacer.Replace(text)
+	}
+}
+
+type recordingUpdate struct {
+	Update
+	mu      sync.Mutex
+	replies []TranscriptReply
+}
+
+func (upd *recordingUpdate) CanShareContact() bool {
+	return CanShareContact(upd.Update)
+}
+
+func (upd *recordingUpdate) Reply(text string) error {
+	return upd.ReplyWithKeyboard(text, Keyboard{})
+}
+
+func (upd *recordingUpdate) ReplyRemovingKeyboard(text string) error {
+	upd.record(TranscriptReply{Text: text, RemoveKeyboard: true})
+	return upd.Update.ReplyRemovingKeyboard(text)
+}
+
+func (upd *recordingUpdate) ReplyWithKeyboard(text string, kb Keyboard) error {
+	reply := TranscriptReply{Text: text}
+	for _, row := range kb.Rows {
+		texts := make([]string, 0, len(row))
+		for _, button := range row {
+			texts = append(texts, button.Text)
+		}
+		if len(texts) > 0 {
+			reply.Keyboard = append(reply.Keyboard, texts)
+		}
+	}
+	upd.record(reply)
+	return upd.Update.ReplyWithKeyboard(text, kb)
+}
+
+func (upd *recordingUpdate) record(reply TranscriptReply) {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	upd.replies = append(upd.replies, reply)
+}
@@ -0,0 +1,70 @@
+package conversation_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spanditime/go-survey-bot/conversation"
+	"github.com/spanditime/go-survey-bot/conversation/conversationtest"
+)
+
+// replies with everything it knows about the sender
+type echoHandler struct{}
+
+func (echoHandler) Welcome(ctx conversation.Ctx) error { return nil }
+
+func (echoHandler) Handle(ctx conversation.Ctx) error {
+	update := ctx.Update()
+	return update.ReplyWithKeyboard(update.GetMessage(), conversation.Keyboard{
+		Rows: [][]conversation.Button{{{Text: update.GetSender().FullName()}, {Text: "@" + update.GetSender().UserName}}},
+	})
+}
+
+func TestRecordingMiddlewareAnonymizes(t *testing.T) {
+	var recorded bytes.Buffer
+	manager := conversation.NewManager(func() conversation.Handler { return echoHandler{} })
+	manager.Use(conversation.RecordingMiddleware(&recorded))
+	agent := conversationtest.Start(t, manager)
+	agent.Sender = conversation.User{Name: "Ivan", Surname: "Petrov", Id: "42", UserName: "ivanpetrov"}
+
+	if _, err := agent.Send("tg42", "Ivan Petrov, ivan@mail.ru, +7 (916) 123-45-67, t.me/ivanpetrov"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.Send("tg42", "again"); err != nil {
+		t.Fatal(err)
+	}
+	// pressed button is not a typed answer
+	if _, err := agent.Send("tg42", "@ivanpetrov"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(recorded.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("recorded %d entries, want 3", len(lines))
+	}
+	for _, private := range []string{"Ivan", "Petrov", "ivan@mail.ru", "916", "tg42"} {
+		if strings.Contains(recorded.String(), private) {
+			t.Errorf("transcript contains %q:\n%s", private, recorded.String())
+		}
+	}
+	var first, second, third conversation.TranscriptEntry
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	json.Unmarshal([]byte(lines[2]), &third)
+	// typed answers keep their shape so they pass the same validators on replay
+	wantSay := "Xxxx Xxxx, xxxx@xxxxxxx.xxx, +70000000000, x.xx/xxxxxx"
+	if first.Say != wantSay || first.Replies[0].Text != wantSay {
+		t.Errorf("recorded %q and reply %q, want %q", first.Say, first.Replies[0].Text, wantSay)
+	}
+	if second.Say != "xxxxx" || third.Say != "@tester" {
+		t.Errorf("recorded %q and %q, want typed answer masked and button anonymized", second.Say, third.Say)
+	}
+	if got := first.Replies[0].Keyboard[0]; got[0] != "Test User" || got[1] != "@tester" {
+		t.Errorf("recorded keyboard %q", got)
+	}
+	if first.Chat != second.Chat {
+		t.Errorf("chat is anonymized differently within one recording: %s and %s", first.Chat, second.Chat)
+	}
+}
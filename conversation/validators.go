@@ -0,0 +1,62 @@
+package conversation
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// answer check with the message shown to the user when answer doesnt pass
+type Validator struct {
+	Check   func(answer string) bool
+	Message string
+}
+
+func NonEmpty(message string) Validator {
+	return Validator{
+		Check:   func(answer string) bool { return strings.TrimSpace(answer) != "" },
+		Message: message,
+	}
+}
+
+func MaxLength(max int, message string) Validator {
+	return Validator{
+		Check:   func(answer string) bool { return utf8.RuneCountInString(answer) <= max },
+		Message: message,
+	}
+}
+
+// whole number within [min, max]
+func IntRange(min, max int, message string) Validator {
+	return Validator{
+		Check: func(answer string) bool {
+			n, err := strconv.Atoi(strings.TrimSpace(answer))
+			return err == nil && n >= min && n <= max
+		},
+		Message: message,
+	}
+}
+
+func Regexp(re *regexp.Regexp, message string) Validator {
+	return Validator{
+		Check:   re.MatchString,
+		Message: message,
+	}
+}
+
+// runs next only if answer passes all validators, otherwise replies with the message of the first failed one
+// handler stays on the same stage so the question is asked again
+func ValidateAction(validators []Validator, next Action) Action {
+	if len(validators) == 0 {
+		return next
+	}
+	return func(answer string, ctx Ctx) error {
+		for _, v := range validators {
+			if !v.Check(answer) {
+				return ctx.Update().Reply(v.Message)
+			}
+		}
+		return next(answer, ctx)
+	}
+}
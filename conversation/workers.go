@@ -0,0 +1,85 @@
+package conversation
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	DefaultWorkers = 8
+	// updates waiting in one chat, more are dropped so a flooding chat cant eat the memory
+	maxChatQueue = 64
+)
+
+// every chat has its own queue so its updates are handled in order,
+// up to size chats are handled at once and a busy chat never holds up others
+type workerPool struct {
+	process func(update Update)
+	// taken while an update is handled
+	slots chan struct{}
+
+	mu sync.Mutex
+	// updates waiting in chats that are being handled
+	chats map[string][]Update
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(size int, process func(update Update)) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &workerPool{
+		process: process,
+		slots:   make(chan struct{}, size),
+		chats:   make(map[string][]Update),
+	}
+}
+
+// queues the update behind the others of its chat, never blocks
+func (p *workerPool) Dispatch(update Update) {
+	chatID := update.ChatID()
+	p.mu.Lock()
+	queue, running := p.chats[chatID]
+	switch {
+	case !running:
+		p.chats[chatID] = nil
+		p.wg.Add(1)
+		go p.run(chatID, update)
+	case len(queue) < maxChatQueue:
+		p.chats[chatID] = append(queue, update)
+	default:
+		p.mu.Unlock()
+		log.Printf("chat %s: too many updates waiting, dropping one", chatID)
+		if completer, ok := update.(Completer); ok {
+			completer.Complete()
+		}
+		return
+	}
+	p.mu.Unlock()
+}
+
+// handles updates of the chat until its queue is empty
+func (p *workerPool) run(chatID string, update Update) {
+	defer p.wg.Done()
+	for {
+		p.slots <- struct{}{}
+		p.process(update)
+		<-p.slots
+
+		p.mu.Lock()
+		queue := p.chats[chatID]
+		if len(queue) == 0 {
+			delete(p.chats, chatID)
+			p.mu.Unlock()
+			return
+		}
+		update = queue[0]
+		p.chats[chatID] = queue[1:]
+		p.mu.Unlock()
+	}
+}
+
+// waits for the queued updates to be handled, nothing can be dispatched after that
+func (p *workerPool) Stop() {
+	p.wg.Wait()
+}
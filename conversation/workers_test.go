@@ -0,0 +1,57 @@
+package conversation
+
+import (
+	"testing"
+	"time"
+)
+
+// update of a chat, nothing is sent
+type chatUpdate string
+
+func (upd chatUpdate) Provider() string                         { return "test" }
+func (upd chatUpdate) ChatID() string                           { return string(upd) }
+func (upd chatUpdate) GetSender() User                          { return User{} }
+func (upd chatUpdate) GetMessage() string                       { return "" }
+func (upd chatUpdate) GetAttachments() []Attachment             { return nil }
+func (upd chatUpdate) Reply(string) error                       { return nil }
+func (upd chatUpdate) ReplyWithKeyboard(string, Keyboard) error { return nil }
+func (upd chatUpdate) ReplyRemovingKeyboard(string) error       { return nil }
+
+func TestBusyChatDoesntHoldUpOthers(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan string, 100)
+	pool := newWorkerPool(2, func(update Update) {
+		if update.ChatID() == "slow" {
+			<-release
+		}
+		handled <- update.ChatID()
+	})
+
+	dispatched := make(chan struct{})
+	go func() {
+		for range 50 {
+			pool.Dispatch(chatUpdate("slow"))
+		}
+		pool.Dispatch(chatUpdate("fast"))
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked by the busy chat")
+	}
+	select {
+	case chat := <-handled:
+		if chat != "fast" {
+			t.Errorf("%s handled first, want fast", chat)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fast chat waits for the busy one")
+	}
+
+	close(release)
+	pool.Stop()
+	if n := len(handled); n != 50 {
+		t.Errorf("handled %d updates of the busy chat, want 50", n)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 	_ "time/tzdata"
 
+	"github.com/spanditime/go-survey-bot/conversation/survey"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
@@ -40,21 +43,15 @@ func newSuveyDB(credentialsFile string, spreadsheetId string, list string, locat
 	}
 }
 
-func (db *SurveyDB) WriteAnswers(ID string, time time.Time, name interface{}, age interface{}, city interface{}, request interface{}, health interface{}, contact interface{}) error {
+func (db *SurveyDB) WriteAnswers(ID string, time time.Time, answers []interface{}) error {
 	range_ := db.list + "!A:A"
+	row := []interface{}{
+		ID,
+		time.UTC().In(db.location).Format("02/01/2006 15:04:05") + " " + db.location.String(),
+	}
 	valuerange := sheets.ValueRange{
-
 		Values: [][]interface{}{
-			{
-				ID,
-				time.UTC().In(db.location).Format("02/01/2006 15:04:05") + " " + db.location.String(),
-				name,
-				age,
-				city,
-				request,
-				health,
-				contact,
-			},
+			append(row, answers...),
 		},
 	}
 
@@ -62,3 +59,16 @@ func (db *SurveyDB) WriteAnswers(ID string, time time.Time, name interface{}, ag
 
 	return err
 }
+
+// survey sink, one row per submission
+func (db *SurveyDB) Submit(s survey.Submission) error {
+	answers := make([]interface{}, len(s.Answers))
+	for i, answer := range s.Answers {
+		answers[i] = answer.Value
+		// links or ids of the attached files go to the same cell
+		if len(answer.Files) > 0 {
+			answers[i] = strings.TrimSpace(fmt.Sprint(answer.Value, "\n", strings.Join(answer.Files, "\n")))
+		}
+	}
+	return db.WriteAnswers(s.ChatID, s.Time, answers)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spanditime/go-survey-bot/conversation/survey"
+)
+
+// survey sink that appends submissions to a file, one json object per line
+// used for local runs without google sheets
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+type fileSubmission struct {
+	ChatID   string            `json:"chat_id"`
+	Provider string            `json:"provider"`
+	Time     time.Time         `json:"time"`
+	Answers  map[string]string `json:"answers"`
+	// references to the attached files by answer key
+	Files map[string][]string `json:"files,omitempty"`
+	// numbers shared with the contact button by answer key
+	Phones map[string]string `json:"phones,omitempty"`
+}
+
+func (f *FileSink) Submit(s survey.Submission) error {
+	record := fileSubmission{
+		ChatID:   s.ChatID,
+		Provider: s.Provider,
+		Time:     s.Time,
+		Answers:  make(map[string]string, len(s.Answers)),
+	}
+	for _, answer := range s.Answers {
+		record.Answers[answer.Key] = fmt.Sprint(answer.Value)
+		if len(answer.Files) > 0 {
+			if record.Files == nil {
+				record.Files = make(map[string][]string)
+			}
+			record.Files[answer.Key] = answer.Files
+		}
+		if answer.Phone != "" {
+			if record.Phones == nil {
+				record.Phones = make(map[string]string)
+			}
+			record.Phones[answer.Key] = answer.Phone
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -8,10 +8,16 @@ replace github.com/spanditime/go-survey-bot/conversation => ./conversation
 
 replace github.com/spanditime/go-survey-bot/vk => ./agents/vk
 
+replace github.com/spanditime/go-survey-bot/web => ./agents/web
+
+replace github.com/spanditime/go-survey-bot/console => ./agents/console
+
 require (
+	github.com/spanditime/go-survey-bot/console v0.0.0-00010101000000-000000000000
 	github.com/spanditime/go-survey-bot/conversation v0.0.0-00010101000000-000000000000
 	github.com/spanditime/go-survey-bot/telegram v0.0.0-00010101000000-000000000000
 	github.com/spanditime/go-survey-bot/vk v0.0.0-00010101000000-000000000000
+	github.com/spanditime/go-survey-bot/web v0.0.0-00010101000000-000000000000
 	google.golang.org/api v0.222.0
 )
 
@@ -31,6 +37,7 @@ require (
 	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.58.0 // indirect
 	go.opentelemetry.io/otel v1.34.0 // indirect
@@ -44,4 +51,5 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250212204824-5a70512c5d8b // indirect
 	google.golang.org/grpc v1.70.0 // indirect
 	google.golang.org/protobuf v1.36.5 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,263 +1,216 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"log"
-
+	consoleagent "github.com/spanditime/go-survey-bot/console"
 	"github.com/spanditime/go-survey-bot/conversation"
+	"github.com/spanditime/go-survey-bot/conversation/survey"
 	tg "github.com/spanditime/go-survey-bot/telegram"
 	"github.com/spanditime/go-survey-bot/vk"
+	"github.com/spanditime/go-survey-bot/web"
 )
 
-// library part
-
-// app logic part
-
-func newYesNoConversationHandler(question string, welcome conversation.Action, no conversation.Action, yes conversation.Action, cancel conversation.Action) *conversation.OptionsHandler {
-	handlers := conversation.OptionsHandlers{
-		Yes: yes,
-		No:  no,
-	}
-	handlers[Cancel] = cancel
-	return conversation.NewOptionsHandler(welcome, question, handlers, conversation.EmptyAction())
-}
-
 const (
-	Cancel        = "Отмена"
-	Submit        = "Отправить"
-	ChangeName    = "Изменить имя"
-	ChangeAge     = "Изменить возраст"
-	ChangeCity    = "Изменить готовность к очным встречам"
-	ChangeRequest = "Изменить запрос"
-	ChangeHealth  = "Изменить информацию о здоровье"
-	ChangeContact = "Изменить контактные данные"
-
-	StartMessage = "Используйте /start что бы начать."
-
-	WelcomeMessage = `Добрый день, уважаемые друзья! Мы - студенты направления клинический психологии в г. Дубна. 
-
-  Здесь Вы можете оставить заявку на бесплатное психологическое консультирование. Консультации проводятся под супервизией преподавателей (разбором случаев без обозначения личных данных для определения корректного пути работы).
-  В свою очередь, мы ожидаем от Вас готовность серьезно работать над своей проблемой совместно с психологом.
-
-  Спектры проблем и переживаний, с которыми Вы можете к нам обратиться:
-  - сложности в межличностных отношениях (дружеских, романтических, семейных и т.д.)
-  - трудности в учёбе (стресс, страх публичных выступлений, тревожность, прокрастинация, тремор при общении с коллегами и преподавателями, страх совершать ошибки);
-  - обеспокоенность своим психологическим состоянием (вредные привычки, нестабильная самооценка и эмоциональность, страхи, трудности в проявлении чувств и сопереживании, стремление к соперничеству, психосоматические симптомы, болезненное восприятие критики, невозможность "понять себя"). 
-
-  Если у Вас есть вопросы - можете задать их в @karevaina или по почте: clin.psy@mail.ru.`
-	GoToSurvey   = `В данный момент ведется активный набор на консультации. Хотите оставить заявку?`
-	EnterName    = "Как мы можем к Вам обращаться?"
-	EnterAge     = "Подскажите, сколько Вам лет?"
-	EnterCity    = "Вы готовы приходить на встречи очно в городе Дубна? (К сожалению, не все студенты готовы брать на онлайн-консультации, поэтому вероятность попасть на очное консультирование выше, чем онлайн)"
-	EnterRequest = "Пожалуйста, попробуйте описать Ваш запрос в одном или двух предложениях (что Вас беспокоит или что хотелось бы изменить)."
-	EnterHealth  = "Есть ли у Вас жалобы на здоровье, хронические заболевания? Если да, пожалуйста, укажите их."
-	EnterContact = "Как мы можем связаться с вами? Просим оставить вас ссылку на соц. сети, почту или номер телефона (и предпочтительный тип связи по нему)."
-	Accept       = "Информация верна?"
-	Thanks       = "Благодарим за обращение! Мы рассмотрим заявку и свяжемся с Вами в случае, если найдется специалист."
-	Yes          = "Да"
-	No           = "Нет"
-
-	NameKey    = "name"
-	AgeKey     = "age"
-	CityKey    = "city"
-	RequestKey = "request"
-	HealthKey  = "health"
-	ContactKey = "contact"
-
 	DATE_SAVE_LOCATION    = "SURV_DATE_SAVE_LOCATION"
+	SESSION_FILE          = "SURV_SESSION_FILE"
+	DEFINITION_FILE       = "SURV_DEFINITION_FILE"
+	WORKERS               = "SURV_WORKERS"
+	BLOCKLIST             = "SURV_BLOCKLIST"
+	FLOOD_LIMIT           = "SURV_FLOOD_LIMIT"
+	CHAT_POLICY           = "SURV_CHAT_POLICY"
 	GOOGLE_CRED           = "GOOGLE_CREDENTIALS_FILE"
 	GOOGLE_SHEET_NAME     = "GOOGLE_SHEET_NAME"
 	GOOGLE_SPREADSHEET_ID = "GOOGLE_SPREADSHEET_ID"
 	TELEGRAM_TOKEN        = "TELEGRAM_BOT_TOKEN"
+	TELEGRAM_WEBHOOK_URL  = "TELEGRAM_WEBHOOK_URL"
+	TELEGRAM_LISTEN       = "TELEGRAM_WEBHOOK_LISTEN"
+	TELEGRAM_SECRET       = "TELEGRAM_WEBHOOK_SECRET"
+	TELEGRAM_CERT         = "TELEGRAM_WEBHOOK_CERT"
+	TELEGRAM_KEY          = "TELEGRAM_WEBHOOK_KEY"
 	VK_TOKEN              = "VK_BOT_TOKEN"
+	VK_CONFIRMATION       = "VK_CALLBACK_CONFIRMATION"
+	VK_LISTEN             = "VK_CALLBACK_LISTEN"
+	VK_PATH               = "VK_CALLBACK_PATH"
+	VK_SECRET             = "VK_CALLBACK_SECRET"
+	VK_CERT               = "VK_CALLBACK_CERT"
+	VK_KEY                = "VK_CALLBACK_KEY"
+	WEB_LISTEN            = "WEB_LISTEN"
+	WEB_CERT              = "WEB_CERT"
+	WEB_KEY               = "WEB_KEY"
+	SUBMISSIONS_FILE      = "SURV_SUBMISSIONS_FILE"
+	TRANSCRIPT_FILE       = "SURV_TRANSCRIPT_FILE"
+
+	DefaultDefinitionFile  = "survey.yaml"
+	DefaultFloodLimit      = 30
+	DefaultTelegramListen  = ":8080"
+	DefaultVKListen        = ":8081"
+	DefaultSubmissionsFile = "submissions.jsonl"
+
+	FloodMessage = "Вы отправляете слишком много сообщений, пожалуйста, подождите минуту."
+	GroupMessage = "Пожалуйста, напишите мне в личные сообщения, в общих чатах я не провожу опрос."
 )
 
-type surveyFabric struct {
-	db *SurveyDB
-}
+var agentMode = flag.String("agent", "", "run only this agent instead of the bots configured by the environment, \"console\" to go through the survey in the terminal")
 
-func (f *surveyFabric) newStartQuestion() conversation.Handler {
-	handle := func(answer string, ctx conversation.Ctx) error {
-		if answer == "/start" {
-			return conversation.TransitionStageAction(f.newWelcomeQuestion)(answer, ctx)
-		}
-		return nil
+func newSurvey(console bool) (*survey.Definition, *survey.Survey) {
+	definitionFile, found := os.LookupEnv(DEFINITION_FILE)
+	if !found {
+		definitionFile = DefaultDefinitionFile
 	}
-	cancel := conversation.TransitionStageAction(f.newStartQuestion)
-	handlers := conversation.OptionsHandlers{
-		"/start": handle,
+	def, err := survey.Load(definitionFile)
+	if err != nil {
+		panic(err)
 	}
-	return conversation.NewOptionsHandler(conversation.EmptyAction(), StartMessage, handlers, cancel)
-}
-
-func (f *surveyFabric) newWelcomeQuestion() conversation.Handler {
-	next := conversation.TransitionStageActionCtx(f.newNameQuestion(false))
-	cancel := conversation.TransitionStageAction(f.newStartQuestion)
-	return newYesNoConversationHandler(GoToSurvey, conversation.SendTextAction(WelcomeMessage, conversation.EmptyAction()), cancel, next, cancel)
-}
-
-func saveSurveyAnswer(key string, fall bool, save conversation.Action, next conversation.Action) conversation.Action {
-	var action conversation.Action
-	if fall {
-		action = conversation.SaveKeyAction(key, save)
-	} else {
-		action = conversation.SaveKeyAction(key, next)
+	// only the sink used by the survey is created, console runs always write to a file
+	sinks := map[string]func() survey.Sink{
+		"sheets": func() survey.Sink {
+			return newSuveyDB(os.Getenv(GOOGLE_CRED), os.Getenv(GOOGLE_SPREADSHEET_ID), os.Getenv(GOOGLE_SHEET_NAME), os.Getenv(DATE_SAVE_LOCATION))
+		},
+		"file": func() survey.Sink {
+			submissionsFile, found := os.LookupEnv(SUBMISSIONS_FILE)
+			if !found {
+				submissionsFile = DefaultSubmissionsFile
+			}
+			return newFileSink(submissionsFile)
+		},
 	}
-	return action
+	sinkName := def.Sink
+	if console {
+		sinkName = "file"
+	}
+	newSink, found := sinks[sinkName]
+	if !found {
+		panic(fmt.Errorf("unknown survey sink %q", sinkName))
+	}
+	s, err := survey.Compile(def, map[string]survey.Sink{def.Sink: newSink()})
+	if err != nil {
+		panic(err)
+	}
+	return def, s
 }
 
-func (f *surveyFabric) newNameQuestion(fall bool) func(answer string, ctx conversation.Ctx) conversation.Handler {
-	return func(answer string, ctx conversation.Ctx) conversation.Handler {
-		cancel := conversation.TransitionStageAction(f.newStartQuestion)
-		defaultName := ctx.Update().GetSender().FullName()
-		save := saveSurveyAnswer(NameKey, fall, conversation.TransitionStageActionCtx(f.newSaveQuestion), conversation.TransitionStageActionCtx(f.newAgeQuestion(false)))
-		handlers := conversation.OptionsHandlers{
-			Cancel:      cancel,
-			defaultName: save,
-		}
-		return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterName, handlers, save)
+func main() {
+	flag.Parse()
+	console := *agentMode == "console"
+	if *agentMode != "" && !console {
+		panic(fmt.Errorf("unknown agent %q", *agentMode))
 	}
-}
+	def, surv := newSurvey(console)
 
-func (f *surveyFabric) newAgeQuestion(fall bool) func(answer string, ctx conversation.Ctx) conversation.Handler {
-	return func(answer string, ctx conversation.Ctx) conversation.Handler {
-		cancel := conversation.TransitionStageAction(f.newStartQuestion)
-		save := saveSurveyAnswer(AgeKey, fall, conversation.TransitionStageActionCtx(f.newSaveQuestion), conversation.TransitionStageActionCtx(f.newCityQuestion(false)))
-		handlers := conversation.OptionsHandlers{
-			Cancel: cancel,
-		}
-		// todo: if have age - add age
-		if false {
-			defaultAge := "20"
-			handlers[defaultAge] = save
-		}
-		return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterAge, handlers, save)
+	manager := conversation.NewManager(surv.EntryPoint())
+	if def.ErrorMessage != "" {
+		manager.SetErrorMessage(def.ErrorMessage)
 	}
-}
 
-func (f *surveyFabric) newCityQuestion(fall bool) func(answer string, ctx conversation.Ctx) conversation.Handler {
-	return func(answer string, ctx conversation.Ctx) conversation.Handler {
-		cancel := conversation.TransitionStageAction(f.newStartQuestion)
-		save := saveSurveyAnswer(CityKey, fall, conversation.TransitionStageActionCtx(f.newSaveQuestion), conversation.TransitionStageActionCtx(f.newRequestQuestion(false)))
-		handlers := conversation.OptionsHandlers{
-			Cancel: cancel,
-			Yes:    save,
+	// keep sessions on disk so surveys survive restarts
+	if sessionFile, use := os.LookupEnv(SESSION_FILE); use {
+		store, err := conversation.NewBoltStore(sessionFile, surv.Stages())
+		if err != nil {
+			panic(err)
 		}
-		return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterCity, handlers, save)
+		defer store.Close()
+		manager.SetSessionStore(store)
 	}
-}
 
-func (f *surveyFabric) newRequestQuestion(fall bool) func(answer string, ctx conversation.Ctx) conversation.Handler {
-	return func(answer string, ctx conversation.Ctx) conversation.Handler {
-		cancel := conversation.TransitionStageAction(f.newStartQuestion)
-		save := saveSurveyAnswer(RequestKey, fall, conversation.TransitionStageActionCtx(f.newSaveQuestion), conversation.TransitionStageActionCtx(f.newHealthQuestion(false)))
-		handlers := conversation.OptionsHandlers{
-			Cancel: cancel,
+	manager.Use(conversation.LoggingMiddleware(log.New(log.Writer(), "updates: ", log.LstdFlags)))
+	if blocklist, use := os.LookupEnv(BLOCKLIST); use {
+		manager.Use(conversation.BlocklistMiddleware(strings.Split(blocklist, ",")...))
+	}
+	chatPolicy := conversation.PrivateChatsOnly
+	if policy, use := os.LookupEnv(CHAT_POLICY); use {
+		chatPolicy = conversation.ChatPolicy(policy)
+		if chatPolicy != conversation.PrivateChatsOnly && chatPolicy != conversation.GroupChats {
+			panic(fmt.Errorf("%s must be %s or %s", CHAT_POLICY, conversation.PrivateChatsOnly, conversation.GroupChats))
 		}
-		return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterRequest, handlers, save)
 	}
-}
-
-func (f *surveyFabric) newHealthQuestion(fall bool) func(answer string, ctx conversation.Ctx) conversation.Handler {
-	return func(answer string, ctx conversation.Ctx) conversation.Handler {
-		cancel := conversation.TransitionStageAction(f.newStartQuestion)
-		save := saveSurveyAnswer(HealthKey, fall, conversation.TransitionStageActionCtx(f.newSaveQuestion), conversation.TransitionStageActionCtx(f.newContactQuestion))
-		handlers := conversation.OptionsHandlers{
-			Cancel: cancel,
-			Yes:    save,
-			No:     save,
+	manager.Use(conversation.ChatPolicyMiddleware(chatPolicy, GroupMessage))
+	floodLimit := DefaultFloodLimit
+	if limit, use := os.LookupEnv(FLOOD_LIMIT); use {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			panic(fmt.Errorf("%s must be a number: %w", FLOOD_LIMIT, err))
 		}
-		return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterHealth, handlers, save)
+		floodLimit = n
 	}
-}
-
-func (f *surveyFabric) newContactQuestion(answer string, ctx conversation.Ctx) conversation.Handler {
-	cancel := conversation.TransitionStageAction(f.newStartQuestion)
-	save := conversation.SaveKeyAction(ContactKey, conversation.TransitionStageActionCtx(f.newSaveQuestion))
-	handlers := conversation.OptionsHandlers{
-		Cancel: cancel,
+	// input of the console is not limited so scripts can be piped in
+	if !console {
+		manager.Use(conversation.FloodControlMiddleware(floodLimit, time.Minute, FloodMessage))
 	}
-	// todo: if have contact - add it
-	username := ctx.Update().GetSender().UserName
-	if len(username) > 0 {
-		defaultContact := fmt.Sprint(ctx.Update().Provider(), ": ", username)
-		handlers[defaultContact] = save
+	// anonymized conversations for regression tests, see conversationtest.Replay
+	if transcriptFile, use := os.LookupEnv(TRANSCRIPT_FILE); use {
+		file, err := os.OpenFile(transcriptFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		manager.Use(conversation.RecordingMiddleware(file))
 	}
-	return conversation.NewOptionsHandler(conversation.EmptyAction(), EnterContact, handlers, save)
-}
 
-func (f *surveyFabric) newSaveQuestion(answer string, ctx conversation.Ctx) conversation.Handler {
-	name, _ := ctx.GetKey(NameKey)
-	age, _ := ctx.GetKey(AgeKey)
-	city, _ := ctx.GetKey(CityKey)
-	request, _ := ctx.GetKey(RequestKey)
-	health, _ := ctx.GetKey(HealthKey)
-	contact, _ := ctx.GetKey(ContactKey)
-	question := fmt.Sprintf("%s\n%s\n\n%s\n%s\n\n%s\n%s\n\n%s\n%s\n\n%s\n%s\n\n%s\n%s\n\n%s",
-		EnterName, name,
-		EnterAge, age,
-		EnterCity, city,
-		EnterRequest, request,
-		EnterHealth, health,
-		EnterContact, contact,
-		Accept)
-	saveSurvey := func(answer string, ctx conversation.Ctx) error {
-		if err := conversation.SendTextAction(Thanks, conversation.EmptyAction())(answer, ctx); err != nil {
-			return err
+	if workers, use := os.LookupEnv(WORKERS); use {
+		n, err := strconv.Atoi(workers)
+		if err != nil {
+			panic(fmt.Errorf("%s must be a number: %w", WORKERS, err))
 		}
+		manager.SetWorkers(n)
+	}
 
-		id := ctx.Update().ChatID()
-		contact = fmt.Sprintf("%s (%s: %s)", contact, ctx.Update().Provider(), ctx.Update().GetSender().UserName)
-		err := f.db.WriteAnswers(
-			id,
-			time.Now(),
-			name,
-			age,
-			city,
-			request,
-			health,
-			contact,
-		)
+	if console {
+		consolebot, err := consoleagent.NewBot(os.Stdin, os.Stdout, conversation.User{
+			Name:     os.Getenv("USER"),
+			Id:       "console",
+			UserName: os.Getenv("USER"),
+		})
 		if err != nil {
-			// todo: log an error
-			log.Printf("Cant write survey results for user %s %s: %v", id, contact, err)
-			// todo: notify user
+			panic(err)
 		}
-		return conversation.TransitionStageAction(f.newStartQuestion)(answer, ctx)
+		manager.AddAgent(consolebot)
+	} else {
+		addBots(manager, def)
 	}
-	return conversation.NewOptionsHandler(conversation.EmptyAction(), question, conversation.OptionsHandlers{
-		Submit:        saveSurvey,
-		ChangeName:    conversation.TransitionStageActionCtx(f.newNameQuestion(true)),
-		ChangeAge:     conversation.TransitionStageActionCtx(f.newAgeQuestion(true)),
-		ChangeCity:    conversation.TransitionStageActionCtx(f.newCityQuestion(true)),
-		ChangeRequest: conversation.TransitionStageActionCtx(f.newRequestQuestion(true)),
-		ChangeHealth:  conversation.TransitionStageActionCtx(f.newHealthQuestion(true)),
-		ChangeContact: conversation.TransitionStageActionCtx(f.newContactQuestion),
-		Cancel: func(answer string, ctx conversation.Ctx) error {
-			// note: clear context storage might be needed
-			return conversation.TransitionStageAction(f.newStartQuestion)(answer, ctx)
-		},
-	}, conversation.EmptyAction())
-}
 
-func newSurveyFabric() *surveyFabric {
-	return &surveyFabric{
-		db: newSuveyDB(os.Getenv(GOOGLE_CRED), os.Getenv(GOOGLE_SPREADSHEET_ID), os.Getenv(GOOGLE_SHEET_NAME), os.Getenv(DATE_SAVE_LOCATION)),
+	// stop on docker stop/ctrl+c, updates already received are handled before exit
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := manager.Run(ctx); err != nil {
+		log.Println(err.Error())
+		return
 	}
+	log.Println("stopped")
 }
 
-func main() {
-	survey := newSurveyFabric()
-
-	manager := conversation.NewManager(survey.newStartQuestion)
-
+// registers agents configured by the environment
+func addBots(manager *conversation.Manager, def *survey.Definition) {
 	// register tg bot agent
 	if tgtoken, use := os.LookupEnv(TELEGRAM_TOKEN); use {
 		tglogger := log.New(log.Writer(), "tgbot: ", log.LstdFlags&log.Lshortfile)
-		tgbot, err := tg.NewBot(tgtoken, tglogger)
+		var tgbot conversation.Agent
+		var err error
+		// webhook mode if url is set, long polling otherwise
+		if webhookURL, use := os.LookupEnv(TELEGRAM_WEBHOOK_URL); use {
+			listen, found := os.LookupEnv(TELEGRAM_LISTEN)
+			if !found {
+				listen = DefaultTelegramListen
+			}
+			tgbot, err = tg.NewWebhookBot(tgtoken, tg.WebhookConfig{
+				URL:         webhookURL,
+				Listen:      listen,
+				SecretToken: os.Getenv(TELEGRAM_SECRET),
+				CertFile:    os.Getenv(TELEGRAM_CERT),
+				KeyFile:     os.Getenv(TELEGRAM_KEY),
+			}, tglogger)
+		} else {
+			tgbot, err = tg.NewBot(tgtoken, tglogger)
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -267,12 +220,43 @@ func main() {
 	// register vk bot agent
 	if vktoken, use := os.LookupEnv(VK_TOKEN); use {
 		vklogger := log.New(log.Writer(), "vkbot: ", log.LstdFlags&log.Lshortfile)
-		vkbot, err := vk.NewBot(vktoken, vklogger)
+		var vkbot conversation.Agent
+		var err error
+		// callback api if confirmation string is set, long poll otherwise
+		if confirmation, use := os.LookupEnv(VK_CONFIRMATION); use {
+			listen, found := os.LookupEnv(VK_LISTEN)
+			if !found {
+				listen = DefaultVKListen
+			}
+			vkbot, err = vk.NewCallbackBot(vktoken, vk.CallbackConfig{
+				Listen:       listen,
+				Path:         os.Getenv(VK_PATH),
+				Confirmation: confirmation,
+				SecretKey:    os.Getenv(VK_SECRET),
+				CertFile:     os.Getenv(VK_CERT),
+				KeyFile:      os.Getenv(VK_KEY),
+			}, vklogger)
+		} else {
+			vkbot, err = vk.NewBot(vktoken, vklogger)
+		}
 		if err != nil {
 			panic(err)
 		}
 		manager.AddAgent(vkbot)
 	}
 
-	log.Println(manager.Run().Error())
+	// register web agent
+	if listen, use := os.LookupEnv(WEB_LISTEN); use {
+		weblogger := log.New(log.Writer(), "web: ", log.LstdFlags&log.Lshortfile)
+		webbot, err := web.NewBot(web.Config{
+			Listen:   listen,
+			Start:    def.Start.Command,
+			CertFile: os.Getenv(WEB_CERT),
+			KeyFile:  os.Getenv(WEB_KEY),
+		}, weblogger)
+		if err != nil {
+			panic(err)
+		}
+		manager.AddAgent(webbot)
+	}
 }